@@ -1,33 +1,124 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"trustgrid.io/jsoninator/plan"
 )
 
-func setLogLevel() {
-	if level, ok := os.LookupEnv("LOG_LEVEL"); ok {
-		var lvl slog.Level
-		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+// setupLogging logs to stderr at the LOG_LEVEL level, with known secrets
+// masked.
+func setupLogging() {
+	var level slog.LevelVar
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &level})
+	slog.SetDefault(slog.New(plan.NewRedactingHandler(handler)))
+
+	if lvl, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		if err := level.UnmarshalText([]byte(lvl)); err != nil {
 			slog.Error("invalid LOG_LEVEL", "err", err)
-			return
 		}
-		slog.SetLogLoggerLevel(lvl)
+	}
+}
+
+// confirmer returns a function that asks the user yes/no questions, reading
+// the answers from in. The same reader is used for every question, so answers
+// that are piped in aren't lost to an earlier question's buffer.
+func confirmer(in *bufio.Reader) func(prompt string) bool {
+	return func(prompt string) bool {
+		fmt.Fprintf(plan.Progress, "%s [y/N] ", prompt)
+		answer, err := in.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+// signalContext returns a context that's cancelled on the first SIGINT or
+// SIGTERM, so the run can wind down cleanly. A second signal exits immediately.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintln(plan.Progress, "Shutting down once in-flight messages finish, signal again to exit immediately")
+		cancel()
+		<-sigs
+		fmt.Fprintln(plan.Progress, "Exiting immediately")
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// testPlan runs a plan's tests, and those in its sibling .test.yaml file if
+// there is one, exiting with an error if any fail.
+func testPlan(planFile string) {
+	f, err := os.ReadFile(planFile)
+	if err != nil {
+		slog.Error("unable to read plan file", "err", err)
+		os.Exit(1)
+	}
+	program, err := plan.Parse(f)
+	if err != nil {
+		slog.Error("unable to parse plan file", "err", err)
+		os.Exit(1)
+	}
+
+	ext := filepath.Ext(planFile)
+	testFile := strings.TrimSuffix(planFile, ext) + ".test" + ext
+	if data, err := os.ReadFile(testFile); err == nil {
+		tests, err := plan.ParseTests(data)
+		if err != nil {
+			slog.Error("unable to parse test file", "file", testFile, "err", err)
+			os.Exit(1)
+		}
+		program.Tests = append(program.Tests, tests...)
+	}
+
+	if len(program.Tests) == 0 {
+		fmt.Println("No tests in", planFile, "or", testFile)
+		os.Exit(1)
+	}
+	if program.RunTests(context.Background(), os.Stdout) > 0 {
+		os.Exit(1)
 	}
 }
 
 func main() {
-	setLogLevel()
+	setupLogging()
 
-	dryrun := flag.Bool("dryrun", true, "When set (the default), this will not write to any outputs")
+	dryrun := flag.Bool("dryrun", true, "When set (the default), this will not write to any outputs other than files and stdout")
 	planFile := flag.String("plan", "", "Path to the plan YAML file")
+	yes := flag.Bool("yes", false, "Continue between rollout waves without asking")
+	resume := flag.String("resume", "", "Report directory of an interrupted run to resume")
+	record := flag.String("record", "", "Directory to save every HTTP exchange to, for -replay")
+	replay := flag.String("replay", "", "Directory of HTTP exchanges saved with -record to answer requests from, instead of the network")
 	flag.Parse()
 
+	if flag.Arg(0) == "test" {
+		if flag.Arg(1) != "" {
+			*planFile = flag.Arg(1)
+		}
+		if *planFile == "" {
+			fmt.Println("Usage: jsoninator test plan.yaml")
+			os.Exit(1)
+		}
+		testPlan(*planFile)
+		return
+	}
+
 	if *planFile == "" {
 		fmt.Println("You must provide a plan file with -plan")
 		return
@@ -37,19 +128,46 @@ func main() {
 		slog.Error("unable to read plan file", "err", err)
 	}
 
-	if *dryrun {
-		fmt.Println("DRY RUN ENABLED: No outputs will be written to")
-	}
-
 	program, err := plan.Parse(f)
 	if err != nil {
 		slog.Error("unable to parse plan file", "err", err)
 		return
 	}
+	if program.UsesStdout() {
+		plan.Progress = os.Stderr
+	}
+
+	if *dryrun {
+		fmt.Fprintln(plan.Progress, "DRY RUN ENABLED: No outputs other than files and stdout will be written to")
+	}
 
 	program.DryRun = *dryrun
+	switch {
+	case *record != "" && *replay != "":
+		fmt.Fprintln(plan.Progress, "-record and -replay can't be used together")
+		return
+	case *record != "":
+		recorder, err := plan.NewRecorder(*record, nil)
+		if err != nil {
+			slog.Error("unable to record", "err", err)
+			return
+		}
+		defer recorder.Close()
+		program.Transport = recorder.Wrap
+	case *replay != "":
+		replayer, err := plan.NewReplayer(*replay)
+		if err != nil {
+			slog.Error("unable to replay", "err", err)
+			return
+		}
+		program.Client = &http.Client{Transport: replayer}
+	}
+	program.ResumeDir = *resume
+	if !*yes {
+		program.Confirm = confirmer(bufio.NewReader(os.Stdin))
+	}
 
-	if err := program.Run(context.Background()); err != nil {
+	if err := program.Run(signalContext()); err != nil {
 		slog.Error("error running plan", "err", err)
 	}
 }
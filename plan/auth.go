@@ -0,0 +1,180 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth authenticates the requests of an HTTP input or output. Only one of its
+// methods should be set.
+type Auth struct {
+	// Bearer is a token sent as "Authorization: Bearer <token>".
+	Bearer string     `yaml:"bearer,omitempty"`
+	Basic  *BasicAuth `yaml:"basic,omitempty"`
+	OAuth2 *OAuth2    `yaml:"oauth2,omitempty"`
+}
+
+// BasicAuth is a username and password sent with HTTP basic authentication.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// OAuth2 gets bearer tokens with the OAuth2 client credentials grant. Tokens
+// are reused until they're about to expire, or until a request using one is
+// rejected with a 401.
+type OAuth2 struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes,flow,omitempty"`
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenLeeway is how long before a token expires that it's replaced, so it
+// doesn't expire while a request is in flight.
+const tokenLeeway = 30 * time.Second
+
+// accessToken returns a token, getting a new one if there isn't one yet, it's
+// about to expire, or it's the rejected token.
+func (o *OAuth2) accessToken(ctx context.Context, rejected string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fresh := o.expiry.IsZero() || time.Now().Add(tokenLeeway).Before(o.expiry)
+	if o.token != "" && o.token != rejected && fresh {
+		return o.token, nil
+	}
+
+	tokenURL, err := resolve(o.TokenURL)
+	if err != nil {
+		return "", err
+	}
+	clientID, err := resolve(o.ClientID)
+	if err != nil {
+		return "", err
+	}
+	clientSecret, err := resolve(o.ClientSecret)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("constructing token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Credentials go in a header rather than the form, so they're redacted
+	// from recordings like any other credentials.
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	resp, err := client(ctx).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading token response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status code %d requesting token: %s", resp.StatusCode, truncate(string(body), maxErrorBody))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("parsing token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access_token")
+	}
+
+	addSecret(token.AccessToken)
+	o.token = token.AccessToken
+	o.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		o.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return o.token, nil
+}
+
+// authorize sets the request's Authorization header. It returns the OAuth2
+// token it used, if any.
+func (a *Auth) authorize(ctx context.Context, req *http.Request, rejected string) (string, error) {
+	switch {
+	case a.OAuth2 != nil:
+		token, err := a.OAuth2.accessToken(ctx, rejected)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return token, nil
+	case a.Basic != nil:
+		username, err := resolve(a.Basic.Username)
+		if err != nil {
+			return "", err
+		}
+		password, err := resolve(a.Basic.Password)
+		if err != nil {
+			return "", err
+		}
+		req.SetBasicAuth(username, password)
+	case a.Bearer != "":
+		token, err := resolve(a.Bearer)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return "", nil
+}
+
+// do sends a request with the context's client, authenticated with a, if it
+// isn't nil. A request with an OAuth2 token that's rejected with a 401 is
+// retried once with a new token.
+func (a *Auth) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if a == nil {
+		return client(ctx).Do(req)
+	}
+
+	token, err := a.authorize(ctx, req, "")
+	if err != nil {
+		return nil, fmt.Errorf("authenticating: %w", err)
+	}
+	resp, err := client(ctx).Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || token == "" {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := a.authorize(ctx, retry, token); err != nil {
+		return nil, fmt.Errorf("authenticating: %w", err)
+	}
+	return client(ctx).Do(retry)
+}
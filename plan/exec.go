@@ -0,0 +1,71 @@
+package plan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Exec runs a local command.
+type Exec struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
+// run runs the command with stdin, returning what it wrote to stdout. If the
+// command exits with an error, the error includes what it wrote to stderr.
+func (e Exec) run(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, e.Command, args...) //nolint:gosec // the plan picks the command
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("running %s: %w: %s", e.Command, err, msg)
+			}
+		}
+		return nil, fmt.Errorf("running %s: %w", e.Command, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (i Input) readExec(ctx context.Context) ([]byte, error) {
+	args := make([]string, 0, len(i.Exec.Args))
+	for n, arg := range i.Exec.Args {
+		resolved, err := resolve(arg)
+		if err != nil {
+			return nil, fmt.Errorf("arg %d: %w", n, err)
+		}
+		args = append(args, resolved)
+	}
+	return i.Exec.run(ctx, args, nil)
+}
+
+// publishExec pipes an item's processed message to the output's command as
+// JSON. Its args are templates, rendered with the same data as headers.
+func (o Output) publishExec(ctx context.Context, item Item) error {
+	args := make([]string, 0, len(o.Exec.Args))
+	data := templateData(item)
+	for i, arg := range o.Exec.Args {
+		rendered, err := renderTemplate(fmt.Sprintf("arg %d", i), secretTemplate(arg), data)
+		if err != nil {
+			return fmt.Errorf("rendering arg %d: %w", i, err)
+		}
+		args = append(args, rendered)
+	}
+
+	msg, err := json.Marshal(item.Message)
+	if err != nil {
+		return err
+	}
+	_, err = o.Exec.run(ctx, args, append(msg, '\n'))
+	return err
+}
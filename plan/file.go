@@ -0,0 +1,164 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Progress is where progress messages are written. It's stdout unless a plan
+// writes its output there.
+var Progress io.Writer = os.Stdout
+
+// stdout is where stdout outputs write, so tests can capture it.
+var stdout io.Writer = os.Stdout
+
+// FileOutput writes processed messages to local files.
+type FileOutput struct {
+	// Path is the file to write. With the "files" format, it's a template with
+	// the original message as its data context, and each message is written
+	// to the file it names.
+	Path string `yaml:"path"`
+	// Format is "ndjson" (the default) for one message per line, "json" for a
+	// single array of messages, or "files" for a file per message.
+	Format string `yaml:"format"`
+}
+
+// sink writes a stream of messages, as NDJSON or as a JSON array.
+type sink struct {
+	w      io.Writer
+	closer io.Closer
+	array  bool
+	count  int
+}
+
+func (s *sink) write(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !s.array:
+	case s.count == 0:
+		data = append([]byte("[\n"), data...)
+	default:
+		data = append([]byte(",\n"), data...)
+	}
+	if !s.array {
+		data = append(data, '\n')
+	}
+	s.count++
+	_, err = s.w.Write(data)
+	return err
+}
+
+func (s *sink) close() error {
+	var end string
+	switch {
+	case !s.array:
+	case s.count == 0:
+		end = "[]\n"
+	default:
+		end = "\n]\n"
+	}
+	if _, err := io.WriteString(s.w, end); err != nil {
+		return err
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// Open gets the output ready to publish, creating any file it writes to and
+// the HTTP client it has its own configuration for. It
+// must be called before publishing to file or stdout outputs, and Close must
+// be called once publishing is done.
+func (o *Output) Open() error {
+	switch o.File.Format {
+	case "", "ndjson", "json", "files":
+	default:
+		return fmt.Errorf("unknown file format: %q", o.File.Format)
+	}
+
+	if o.File.Path != "" && o.File.Format != "files" {
+		if err := os.MkdirAll(filepath.Dir(o.File.Path), 0755); err != nil { //nolint:gosec // the plan picks the path
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+		f, err := os.Create(o.File.Path)
+		if err != nil {
+			return fmt.Errorf("creating output file: %w", err)
+		}
+		o.fileSink = &sink{w: f, closer: f, array: o.File.Format == "json"}
+	}
+	if o.Stdout {
+		o.stdoutSink = &sink{w: stdout}
+	}
+	if o.HTTP.Client != nil {
+		c, err := o.HTTP.Client.build()
+		if err != nil {
+			return fmt.Errorf("configuring http client: %w", err)
+		}
+		o.httpClient = c
+	}
+	return nil
+}
+
+// Close finishes writing any files the output opened.
+func (o Output) Close() error {
+	if o.fileSink != nil {
+		if err := o.fileSink.close(); err != nil {
+			return fmt.Errorf("closing output file: %w", err)
+		}
+	}
+	if o.stdoutSink != nil {
+		return o.stdoutSink.close()
+	}
+	return nil
+}
+
+// publishLocal writes an item to the output's file and stdout, if it has them.
+// These are written in a dry run too, since they don't change anything outside
+// of the machine jsoninator runs on.
+func (o Output) publishLocal(item Item) error {
+	if o.File.Path != "" {
+		if err := o.publishFile(item); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	}
+	if o.Stdout {
+		if o.stdoutSink == nil {
+			return fmt.Errorf("stdout output isn't open")
+		}
+		if err := o.stdoutSink.write(item.Message); err != nil {
+			return fmt.Errorf("writing to stdout: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishFile writes an item to the output's file, or to its own file with
+// the "files" format.
+func (o Output) publishFile(item Item) error {
+	if o.File.Format != "files" {
+		if o.fileSink == nil {
+			return fmt.Errorf("output file %s isn't open", o.File.Path)
+		}
+		return o.fileSink.write(item.Message)
+	}
+
+	path, err := renderTemplate("file", o.File.Path, item.Original)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(item.Message, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { //nolint:gosec // the plan picks the path
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644) //nolint:gosec // output is meant to be read
+}
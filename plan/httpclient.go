@@ -0,0 +1,138 @@
+package plan
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	clientKey ctxKey = iota + 1
+	configuredClientKey
+	transportKey
+)
+
+// HTTPClient configures how HTTP requests are sent.
+type HTTPClient struct {
+	// Timeout is how long a request may take, eg "30s". There's no limit if
+	// it isn't set.
+	Timeout string `yaml:"timeout,omitempty"`
+	// CACert is a PEM file of certificate authorities to trust, as well as the
+	// system's.
+	CACert string `yaml:"ca_cert,omitempty"`
+	// ClientCert and ClientKey are PEM files of a certificate and its key to
+	// present to servers that ask for one.
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	// InsecureSkipVerify doesn't check servers' certificates. It's only meant
+	// for labs.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// Proxy is the URL of a proxy to send requests through. If it isn't set,
+	// the usual proxy environment variables are used.
+	Proxy string `yaml:"proxy,omitempty"`
+}
+
+// build makes a client with the configuration.
+func (c HTTPClient) build() (*http.Client, error) {
+	var timeout time.Duration
+	if c.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, fmt.Errorf("parsing timeout: %w", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify} //nolint:gosec // opted into for labs
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// WithClient returns a context whose HTTP requests, for inputs, outputs and
+// lookups, are sent with client, regardless of any http_client configuration.
+func WithClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, clientKey, client)
+}
+
+// WithTransport returns a context whose HTTP requests are sent through wrap,
+// which is given the transport of the client that would otherwise have sent
+// them. Clients built from http_client and client blocks keep their settings.
+func WithTransport(ctx context.Context, wrap func(http.RoundTripper) http.RoundTripper) context.Context {
+	return context.WithValue(ctx, transportKey, wrap)
+}
+
+// withClientConfig returns a context whose HTTP requests are sent with a
+// client built from config, unless it's nil. A client from WithClient still
+// takes precedence.
+func withClientConfig(ctx context.Context, config *HTTPClient) (context.Context, error) {
+	if config == nil {
+		return ctx, nil
+	}
+	c, err := config.build()
+	if err != nil {
+		return nil, fmt.Errorf("configuring http client: %w", err)
+	}
+	return context.WithValue(ctx, configuredClientKey, c), nil
+}
+
+// client is the HTTP client to send requests with: the one from WithClient,
+// then the most specific configured one, and otherwise http.DefaultClient. Its
+// transport is wrapped by the one from WithTransport, if there is one.
+func client(ctx context.Context) *http.Client {
+	c := http.DefaultClient
+	if cc, ok := ctx.Value(clientKey).(*http.Client); ok && cc != nil {
+		c = cc
+	} else if cc, ok := ctx.Value(configuredClientKey).(*http.Client); ok && cc != nil {
+		c = cc
+	}
+
+	wrap, ok := ctx.Value(transportKey).(func(http.RoundTripper) http.RoundTripper)
+	if !ok || wrap == nil {
+		return c
+	}
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	wrapped := *c
+	wrapped.Transport = wrap(base)
+	return &wrapped
+}
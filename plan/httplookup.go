@@ -0,0 +1,119 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// HTTPLookup fetches related data for each message with a templated GET and
+// attaches the parsed response to the message.
+type HTTPLookup struct {
+	// URL is a template with the current message as its data context.
+	// It can use ${env:NAME} and ${file:/path} secrets, as can Headers.
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Into is the field the parsed response is attached under.
+	Into string `yaml:"into"`
+	// StatusCodes lists the acceptable response codes. Any 2xx is accepted if
+	// it's not set.
+	StatusCodes []int `yaml:"status_codes"`
+
+	cache *sync.Map
+}
+
+func (h HTTPLookup) statusOK(code int) bool {
+	if h.StatusCodes != nil {
+		return slices.Contains(h.StatusCodes, code)
+	}
+	return code >= 200 && code < 300
+}
+
+func (h HTTPLookup) fetch(ctx context.Context, url string) (Message, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("constructing lookup request: %w", err)
+	}
+	for k, v := range h.Headers {
+		value, err := resolve(v)
+		if err != nil {
+			return nil, fmt.Errorf("lookup header %s: %w", k, err)
+		}
+		req.Header.Set(k, value)
+	}
+	resp, err := client(ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending lookup request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading lookup response: %w", err)
+	}
+	if !h.statusOK(resp.StatusCode) {
+		return nil, fmt.Errorf("unexpected status code from %s: %d", url, resp.StatusCode)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("parsing lookup response from %s: %w", url, err)
+	}
+	return msg, nil
+}
+
+// Process implements the Processor interface for HTTPLookup. Responses are
+// cached by URL for the rest of the run, so messages that render the same URL
+// only cause one request.
+func (h HTTPLookup) Process(ctx context.Context, data Message) (Message, error) {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("http_lookup processor expects input to be a map, got %T", data)
+	}
+	if h.Into == "" {
+		return nil, fmt.Errorf("http_lookup processor requires into")
+	}
+
+	url, err := renderTemplate("http_lookup", secretTemplate(h.URL), data)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp Message
+	cached, ok := h.cacheGet(url)
+	if ok {
+		resp = cached
+	} else {
+		resp, err = h.fetch(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		h.cachePut(url, resp)
+	}
+
+	// Later processors may modify the attached response, so each message gets
+	// its own copy of whatever's in the cache.
+	resp, err = deepCopy(resp)
+	if err != nil {
+		return nil, fmt.Errorf("copying lookup response: %w", err)
+	}
+	m[h.Into] = resp
+	return m, nil
+}
+
+func (h HTTPLookup) cacheGet(url string) (Message, bool) {
+	if h.cache == nil {
+		return nil, false
+	}
+	return h.cache.Load(url)
+}
+
+func (h HTTPLookup) cachePut(url string, msg Message) {
+	if h.cache != nil {
+		h.cache.Store(url, msg)
+	}
+}
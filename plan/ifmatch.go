@@ -0,0 +1,80 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errConflict is returned when a publish is rejected because the target
+// changed since its version was read.
+var errConflict = errors.New("conflict")
+
+// IfMatch makes publishes conditional on the target not having changed since
+// it was read, by sending its version in an If-Match header.
+type IfMatch struct {
+	// Field is the dot path of the version. It's looked up in the original
+	// message, or in the pre-read response if Read is set.
+	Field string `yaml:"field"`
+	// Read GETs the output URL before each publish to find the version. The
+	// response's ETag header is used unless Field is set.
+	Read bool `yaml:"read"`
+	// Retries is how many times a message that hits a conflict is re-read
+	// from the input, run through the pipeline again and republished.
+	Retries int `yaml:"retries"`
+}
+
+// version finds the version to send for an item.
+func (o Output) version(ctx context.Context, item Item) (string, error) {
+	ifMatch := o.HTTP.IfMatch
+	if !ifMatch.Read {
+		if ifMatch.Field == "" {
+			return "", fmt.Errorf("if_match needs a field or read")
+		}
+		v, ok := dive(item.Original, strings.Split(ifMatch.Field, "."))
+		if !ok || v == nil {
+			return "", fmt.Errorf("no version at %s", ifMatch.Field)
+		}
+		return fmt.Sprint(v), nil
+	}
+
+	url, err := o.url(item.Original)
+	if err != nil {
+		return "", err
+	}
+	resp, body, err := o.get(ctx, url, item)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status code reading version from %s: %d", url, resp.StatusCode)
+	}
+
+	if ifMatch.Field == "" {
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return "", fmt.Errorf("no ETag reading version from %s", url)
+		}
+		return etag, nil
+	}
+
+	var current Message
+	if err := json.Unmarshal(body, &current); err != nil {
+		return "", fmt.Errorf("parsing response from %s: %w", url, err)
+	}
+	v, ok := dive(current, strings.Split(ifMatch.Field, "."))
+	if !ok || v == nil {
+		return "", fmt.Errorf("no version at %s in response from %s", ifMatch.Field, url)
+	}
+	return fmt.Sprint(v), nil
+}
+
+// retries is how many times a conflicting message may be retried.
+func (o Output) retries() int {
+	if o.HTTP.IfMatch == nil {
+		return 0
+	}
+	return o.HTTP.IfMatch.Retries
+}
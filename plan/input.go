@@ -1,10 +1,15 @@
 package plan
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
 )
 
 // Input represents the input configuration for a run of jsoninator.
@@ -13,25 +18,110 @@ type Input struct {
 	HTTP struct {
 		URL     string            `yaml:"url"`
 		Headers map[string]string `yaml:"headers"`
+		// Method defaults to GET.
+		Method string `yaml:"method"`
+		// Body is sent with the request. A string is sent as it is, and
+		// anything else is sent as JSON.
+		Body any `yaml:"body"`
+		// StatusCodes are the response status codes that are accepted. If
+		// there are none, any 2xx status code is.
+		StatusCodes []int `yaml:"status_codes"`
+		// Auth authenticates the request.
+		Auth *Auth `yaml:"auth"`
+		// Client overrides the plan's http_client for the input.
+		Client *HTTPClient `yaml:"client"`
 	} `yaml:"http"`
 
+	// Exec runs a command and reads its stdout.
+	Exec Exec `yaml:"exec"`
+
 	Raw string `yaml:"raw"`
 }
 
+// maxErrorBody is how much of a response body is included in errors.
+const maxErrorBody = 512
+
+// truncate shortens s to at most n bytes, noting how much was cut.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", s[:n], len(s)-n)
+}
+
+// body is the request body to send, and whether it's JSON.
+func (i Input) body() (io.Reader, bool, error) {
+	resolved, err := resolveBody(i.HTTP.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("request body: %w", err)
+	}
+	switch body := resolved.(type) {
+	case nil:
+		return nil, false, nil
+	case string:
+		return strings.NewReader(body), json.Valid([]byte(body)), nil
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, false, fmt.Errorf("encoding request body: %w", err)
+		}
+		return bytes.NewReader(data), true, nil
+	}
+}
+
 func (i Input) readHTTP(ctx context.Context) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.HTTP.URL, nil)
+	ctx, err := withClientConfig(ctx, i.HTTP.Client)
+	if err != nil {
+		return nil, err
+	}
+	method := i.HTTP.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	body, isJSON, err := i.body()
+	if err != nil {
+		return nil, err
+	}
+
+	url, err := resolve(i.HTTP.URL)
+	if err != nil {
+		return nil, fmt.Errorf("input url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf("constructing read request: %w", err)
 	}
+	if isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	for k, v := range i.HTTP.Headers {
-		req.Header.Set(k, v)
+		value, err := resolve(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", k, err)
+		}
+		req.Header.Set(k, value)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := i.HTTP.Auth.do(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("sending read request: %w", err)
 	}
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if i.HTTP.StatusCodes != nil {
+		ok = slices.Contains(i.HTTP.StatusCodes, resp.StatusCode)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unexpected status code %d from %s %s: %s", resp.StatusCode, method, url, truncate(string(data), maxErrorBody))
+	}
+	return data, nil
 }
 
 // Read fetches the input data according to the configured input method.
@@ -40,6 +130,8 @@ func (i Input) Read(ctx context.Context) ([]byte, error) {
 	switch {
 	case i.HTTP.URL != "":
 		return i.readHTTP(ctx)
+	case i.Exec.Command != "":
+		return i.readExec(ctx)
 	case i.Raw != "":
 		return []byte(i.Raw), nil
 	}
@@ -0,0 +1,192 @@
+package plan
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lookup joins messages against a table loaded from a local CSV, JSON or YAML
+// file. The matched row is either merged into the message or attached under a
+// field so later processors can reference it in their templates.
+type Lookup struct {
+	// File is the path to the table. JSON and YAML tables must be a list of
+	// objects, and CSV tables must have a header row.
+	File string `yaml:"file"`
+	// Format is one of csv, json or yaml. It's inferred from the file
+	// extension if not set.
+	Format string `yaml:"format"`
+	// Key is the dot path of the message field to join on.
+	Key string `yaml:"key"`
+	// Column is the dot path of the row field to join on. It defaults to Key.
+	Column string `yaml:"column"`
+	// Into, when set, attaches the matched row under this field instead of
+	// merging it into the message.
+	Into string `yaml:"into"`
+	// OnMiss decides what happens when no row matches: keep (the default)
+	// passes the message along untouched, drop filters it and error stops the run.
+	OnMiss string `yaml:"on_miss"`
+
+	rows map[string]map[string]any
+}
+
+func (l Lookup) format() string {
+	if l.Format != "" {
+		return strings.ToLower(l.Format)
+	}
+	switch strings.ToLower(filepath.Ext(l.File)) {
+	case ".csv":
+		return "csv"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+func readCSVTable(data []byte) ([]map[string]any, error) {
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	rows := make([]map[string]any, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]any, len(header))
+		for i, col := range header {
+			if i >= len(record) {
+				break
+			}
+			// Like transform output, cells that parse as JSON (numbers, booleans)
+			// keep their type so they can be used as-is.
+			var v any
+			if err := json.Unmarshal([]byte(record[i]), &v); err != nil {
+				v = record[i]
+			}
+			row[col] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// load reads the table from disk and indexes it by the join column. It's
+// called once when the plan is parsed. Rows are only found by their key, so a
+// table with the same key in more than one row is rejected rather than picking
+// one of them.
+func (l *Lookup) load() error {
+	switch l.OnMiss {
+	case "", "keep", "drop", "error":
+	default:
+		return fmt.Errorf("unknown on_miss %q, expected keep, drop or error", l.OnMiss)
+	}
+
+	data, err := os.ReadFile(l.File)
+	if err != nil {
+		return fmt.Errorf("reading lookup table: %w", err)
+	}
+
+	var rows []map[string]any
+	switch l.format() {
+	case "csv":
+		rows, err = readCSVTable(data)
+	case "json":
+		err = json.Unmarshal(data, &rows)
+	case "yaml":
+		err = yaml.Unmarshal(data, &rows)
+	default:
+		return fmt.Errorf("unknown lookup table format: %s", l.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing lookup table %s: %w", l.File, err)
+	}
+
+	column := l.Column
+	if column == "" {
+		column = l.Key
+	}
+
+	l.rows = make(map[string]map[string]any, len(rows))
+	for _, row := range rows {
+		// Round trip through JSON so values have the same types as messages do.
+		normalized, err := deepCopy(row)
+		if err != nil {
+			return fmt.Errorf("normalizing lookup row: %w", err)
+		}
+		r, ok := normalized.(map[string]any)
+		if !ok {
+			continue
+		}
+		k, ok := dive(r, strings.Split(column, "."))
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%v", k)
+		if _, ok := l.rows[key]; ok {
+			return fmt.Errorf("lookup table %s has more than one row for %s %s", l.File, column, key)
+		}
+		l.rows[key] = r
+	}
+
+	return nil
+}
+
+// Process implements the Processor interface for Lookup.
+func (l Lookup) Process(ctx context.Context, data Message) (Message, error) {
+	reporter, ok := ctx.Value(reporterKey).(*Reporter)
+	if !ok {
+		return nil, fmt.Errorf("lookup processor requires reporter in context")
+	}
+
+	m, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("lookup processor expects input to be a map, got %T", data)
+	}
+
+	var row map[string]any
+	key, found := dive(data, strings.Split(l.Key, "."))
+	if found {
+		row, found = l.rows[fmt.Sprintf("%v", key)]
+	}
+
+	if !found {
+		switch l.OnMiss {
+		case "drop":
+			reporter.Skip(fmt.Sprintf("no row in %s for %s %v", l.File, l.Key, key))
+			return nil, nil
+		case "error":
+			return nil, fmt.Errorf("no row in %s for %s %v", l.File, l.Key, key)
+		}
+		return m, nil
+	}
+
+	copied, err := deepCopy(row)
+	if err != nil {
+		return nil, fmt.Errorf("copying lookup row: %w", err)
+	}
+
+	if l.Into != "" {
+		m[l.Into] = copied
+		return m, nil
+	}
+
+	row, _ = copied.(map[string]any)
+	for k, v := range row {
+		if !reflect.DeepEqual(m[k], v) {
+			reporter.Change(k, m[k], v)
+			m[k] = v
+		}
+	}
+
+	return m, nil
+}
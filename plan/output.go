@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"reflect"
 	"slices"
 	"text/template"
 )
@@ -22,56 +23,346 @@ type Output struct {
 		Method      string            `yaml:"method"`
 		Headers     map[string]string `yaml:"headers"`
 		StatusCodes []int             `yaml:"status_codes"`
+		Verify      *Verify           `yaml:"verify"`
+		// SkipUnchanged, if set, only publishes messages that differ from
+		// their current state. "original" compares with the message before the
+		// pipeline changed it, and "fetch" compares with a GET of the URL.
+		SkipUnchanged string `yaml:"skip_unchanged"`
+		// Body is what's sent: "full" (the default) sends the processed
+		// message, and "merge-patch" and "json-patch" send only the difference
+		// between it and the message before the pipeline changed it.
+		Body string `yaml:"body"`
+		// BodyTemplate, if set, is rendered to make the request body instead
+		// of sending the payload as JSON. See templateData for what it can use.
+		BodyTemplate string `yaml:"body_template"`
+		// IfMatch, if set, sends the target's version in an If-Match header so
+		// that the publish fails with a conflict if the target has changed.
+		IfMatch *IfMatch `yaml:"if_match"`
+		// Auth authenticates the output's requests.
+		Auth *Auth `yaml:"auth"`
+		// Client overrides the plan's http_client for the output.
+		Client *HTTPClient `yaml:"client"`
 	} `yaml:"http"`
 
+	// File writes each message to a local file.
+	File FileOutput `yaml:"file"`
+	// Stdout writes each message to stdout as NDJSON.
+	Stdout bool `yaml:"stdout"`
+	// Exec pipes each message to a command's stdin as JSON. The command
+	// exiting with an error fails the publish.
+	Exec Exec `yaml:"exec"`
+
 	Buffer *bytes.Buffer `yaml:"-"`
+
+	fileSink   *sink
+	stdoutSink *sink
+	httpClient *http.Client
+	// written, if set, is called as soon as an HTTP publish has changed the
+	// target, even if something after it fails.
+	written func()
+}
+
+// NamedOutput is one of several outputs a plan publishes to. If it has a When
+// filter, only processed messages that pass it are sent to the output.
+type NamedOutput struct {
+	Name   string  `yaml:"name"`
+	When   *Filter `yaml:"when"`
+	Output `yaml:",inline"`
+}
+
+func renderTemplate(name, text string, data any) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Funcs(template.FuncMap{"resolve": resolve}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("executing template: %w", err)
+	}
+	return out.String(), nil
+}
+
+// url renders the output URL template against the original message.
+func (o Output) url(original Message) (string, error) {
+	return renderTemplate("template", secretTemplate(o.HTTP.URL), original)
+}
+
+// templateData is the data that header values and the body template are
+// rendered with: the original message as .original and the processed message
+// as .processed.
+func templateData(item Item) map[string]any {
+	return map[string]any{
+		"original":  item.Original,
+		"processed": item.Message,
+	}
+}
+
+// headers renders the output's header values for an item.
+func (o Output) headers(item Item) (map[string]string, error) {
+	headers := make(map[string]string, len(o.HTTP.Headers))
+	data := templateData(item)
+	for k, v := range o.HTTP.Headers {
+		value, err := renderTemplate(k, secretTemplate(v), data)
+		if err != nil {
+			return nil, fmt.Errorf("rendering header %s: %w", k, err)
+		}
+		headers[k] = value
+	}
+	return headers, nil
+}
+
+// publishHeaders are headers that describe a publish's body or make it
+// conditional. They're left off reads of the target, which have no body, and
+// which a condition meant for the publish could make fail.
+var publishHeaders = []string{
+	"Content-Type", "Content-Encoding", "Content-Length",
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range",
+}
+
+// get GETs url with the output's headers as rendered for item, apart from
+// publishHeaders, and returns the response along with its body, which has
+// been read and closed.
+func (o Output) get(ctx context.Context, url string, item Item) (*http.Response, []byte, error) {
+	headers, err := o.headers(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for _, k := range publishHeaders {
+		req.Header.Del(k)
+	}
+	resp, err := o.HTTP.Auth.do(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
 }
 
-func (o Output) publishHTTP(ctx context.Context, original, processed Message) error {
+// fetch GETs the current state of the resource at url, with the output's
+// headers as rendered for item. It returns nil if the resource doesn't exist.
+func (o Output) fetch(ctx context.Context, url string, item Item) (Message, error) {
+	resp, body, err := o.get(ctx, url, item)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, fmt.Errorf("unexpected status code fetching %s: %d", url, resp.StatusCode)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("parsing response from %s: %w", url, err)
+	}
+	return msg, nil
+}
+
+// unchanged reports whether publishing an item would leave its target as it
+// is, according to the SkipUnchanged setting.
+func (o Output) unchanged(ctx context.Context, item Item) (bool, error) {
+	current := item.Before
+	switch o.HTTP.SkipUnchanged {
+	case "":
+		return false, nil
+	case "original":
+	case "fetch":
+		url, err := o.url(item.Original)
+		if err != nil {
+			return false, err
+		}
+		if current, err = o.fetch(ctx, url, item); err != nil {
+			return false, fmt.Errorf("fetching current state: %w", err)
+		}
+	default:
+		return false, fmt.Errorf("unknown skip_unchanged mode: %q", o.HTTP.SkipUnchanged)
+	}
+	if current == nil {
+		return false, nil
+	}
+
+	// Normalize both sides the way JSON would, so numbers and the like
+	// compare equal.
+	current, err := deepCopy(current)
+	if err != nil {
+		return false, err
+	}
+	processed, err := deepCopy(item.Message)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(current, processed), nil
+}
+
+// body works out the payload to send for an item, and the Content-Type it
+// needs, if the body mode calls for a specific one.
+func (o Output) body(item Item) (Message, string, error) {
+	switch o.HTTP.Body {
+	case "", "full":
+		return item.Message, "", nil
+	}
+
+	// Diff normalized copies, so numbers and the like compare equal. Messages
+	// without a before state, such as groups, are diffed against nothing.
+	before, err := deepCopy(item.Before)
+	if err != nil {
+		return nil, "", err
+	}
+	processed, err := deepCopy(item.Message)
+	if err != nil {
+		return nil, "", err
+	}
+	if before == nil {
+		before = map[string]any{}
+	}
+
+	switch o.HTTP.Body {
+	case "merge-patch":
+		return mergePatch(before, processed), "application/merge-patch+json", nil
+	case "json-patch":
+		return jsonPatch(before, processed), "application/json-patch+json", nil
+	}
+	return nil, "", fmt.Errorf("unknown body mode: %q", o.HTTP.Body)
+}
+
+// newRequest renders the HTTP request that publishes an item, apart from its
+// If-Match header, which may need the target to be read first. The body is
+// returned as well, for callers that need to look at it.
+func (o Output) newRequest(ctx context.Context, item Item) (*http.Request, []byte, error) {
+	payload, contentType, err := o.body(item)
+	if err != nil {
+		return nil, nil, err
+	}
 	reader := bytes.NewBuffer(nil)
-	if err := json.NewEncoder(reader).Encode(processed); err != nil {
-		return err
+	if o.HTTP.BodyTemplate != "" {
+		data := templateData(item)
+		data["body"] = payload
+		body, err := renderTemplate("body", o.HTTP.BodyTemplate, data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rendering body: %w", err)
+		}
+		reader.WriteString(body)
+	} else if err := json.NewEncoder(reader).Encode(payload); err != nil {
+		return nil, nil, err
 	}
+	body := reader.Bytes()
 
-	tmpl, err := template.New("template").Funcs(templateFuncs).Parse(o.HTTP.URL)
+	url, err := o.url(item.Original)
 	if err != nil {
-		return fmt.Errorf("parsing template: %w", err)
+		return nil, nil, err
 	}
-	var out bytes.Buffer
-	if err := tmpl.Execute(&out, original); err != nil {
-		return fmt.Errorf("executing template: %w", err)
+	headers, err := o.headers(item)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, o.HTTP.Method, out.String(), reader)
+	req, err := http.NewRequestWithContext(ctx, o.HTTP.Method, url, reader)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	for k, v := range o.HTTP.Headers {
+	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, body, nil
+}
+
+func (o Output) publishHTTP(ctx context.Context, item Item) error {
+	req, _, err := o.newRequest(ctx, item)
+	if err != nil {
+		return err
+	}
+	url := req.URL.String()
+	if o.HTTP.IfMatch != nil {
+		version, err := o.version(ctx, item)
+		if err != nil {
+			return fmt.Errorf("reading version: %w", err)
+		}
+		req.Header.Set("If-Match", version)
+	}
+	resp, err := o.HTTP.Auth.do(ctx, req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w: %s changed since it was read", errConflict, url)
+	}
 	if o.HTTP.StatusCodes != nil && !slices.Contains(o.HTTP.StatusCodes, resp.StatusCode) {
 		slog.Error("unexpected status code", "status_code", resp.StatusCode, "expected", o.HTTP.StatusCodes)
 		io.Copy(os.Stderr, resp.Body) //nolint:errcheck // best effort
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
+	if o.written != nil {
+		o.written()
+	}
 
+	// The target has already changed, so a verify that can't read it back
+	// doesn't fail the publish.
+	if o.HTTP.Verify != nil {
+		if err := o.verifyHTTP(ctx, item); err != nil {
+			slog.Error("unable to verify publish", "url", url, "err", err)
+			if reporter, ok := ctx.Value(reporterKey).(*Reporter); ok {
+				reporter.Unverified(err)
+			}
+		}
+	}
 	return nil
 }
 
 // Publish sends the processed message to all configured output methods.
+// The original message is also used as the processed message's state before
+// the pipeline ran; use PublishItem to provide it separately.
 func (o Output) Publish(ctx context.Context, original, processed Message) error {
+	return o.PublishItem(ctx, Item{Original: original, Message: processed, Before: original})
+}
+
+// withClient returns a context whose HTTP requests are sent with the output's
+// client, if it has its own.
+func (o Output) withClient(ctx context.Context) (context.Context, error) {
+	if o.httpClient != nil {
+		return context.WithValue(ctx, configuredClientKey, o.httpClient), nil
+	}
+	return withClientConfig(ctx, o.HTTP.Client)
+}
+
+// PublishItem sends an item that made it through the pipeline to all
+// configured output methods.
+func (o Output) PublishItem(ctx context.Context, item Item) error {
+	ctx, err := o.withClient(ctx)
+	if err != nil {
+		return err
+	}
 	if o.HTTP.URL != "" {
-		if err := o.publishHTTP(ctx, original, processed); err != nil {
+		if err := o.publishHTTP(ctx, item); err != nil {
+			return err
+		}
+	}
+	if err := o.publishLocal(item); err != nil {
+		return err
+	}
+	if o.Exec.Command != "" {
+		if err := o.publishExec(ctx, item); err != nil {
 			return err
 		}
 	}
 	if o.Buffer != nil {
-		if err := json.NewEncoder(o.Buffer).Encode(processed); err != nil {
+		if err := json.NewEncoder(o.Buffer).Encode(item.Message); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,443 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stateServer is a fake API that stores whatever is written to a path and
+// serves it back on GET. If normalize is set, it's applied to each write. GETs
+// with an If-Match header fail, as they would against a real API when the
+// version is out of date. Handler errors are checked once the test is done, as
+// the handler doesn't run on the test's goroutine.
+func stateServer(t *testing.T, normalize func(map[string]any)) (*httptest.Server, map[string]map[string]any) {
+	t.Helper()
+	state := make(map[string]map[string]any)
+
+	var mu sync.Mutex
+	var errs []error
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Empty(t, errs, "state server errors")
+	})
+	fail := func(w http.ResponseWriter, err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.Header.Get("If-Match") != "" {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			current, ok := state[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err := json.NewEncoder(w).Encode(current); err != nil {
+				fail(w, err)
+			}
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		var m map[string]any
+		if err := json.Unmarshal(body, &m); err != nil {
+			fail(w, err)
+			return
+		}
+		if normalize != nil {
+			normalize(m)
+		}
+		state[r.URL.Path] = m
+	}))
+	t.Cleanup(srv.Close)
+	return srv, state
+}
+
+func Test_Output(t *testing.T) {
+	go func() {
+		for {
+			select {
+			case <-reports:
+			case <-t.Context().Done():
+				return
+			}
+		}
+	}()
+
+	t.Run("verify", func(t *testing.T) {
+		srv, _ := stateServer(t, func(m map[string]any) {
+			delete(m, "udpPort")
+		})
+
+		var output Output
+		output.HTTP.URL = srv.URL + "/node/{{.uid}}/config/gateway"
+		output.HTTP.Method = http.MethodPut
+		output.HTTP.Headers = map[string]string{"If-Match": "*"}
+		output.HTTP.Verify = &Verify{}
+
+		ctx, cancel := WithReporter(t.Context(), "test")
+		defer cancel()
+		reporter := ctx.Value(reporterKey).(*Reporter)
+
+		require.NoError(t, output.Publish(ctx, map[string]any{"uid": "1"}, map[string]any{
+			"udpEnabled": true,
+			"udpPort":    8995,
+		}))
+		require.Len(t, reporter.drifts, 1)
+		assert.Equal(t, "udpPort", reporter.drifts[0].name)
+		assert.Equal(t, float64(8995), reporter.drifts[0].before)
+		assert.Nil(t, reporter.drifts[0].after)
+		assert.Equal(t, "drifted", reporter.outcome())
+
+		reporter.drifts = nil
+		output.HTTP.Verify = &Verify{
+			URL:   srv.URL + "/node/{{.uid}}/config/gateway",
+			Paths: []string{"udpEnabled"},
+		}
+		require.NoError(t, output.Publish(ctx, map[string]any{"uid": "1"}, map[string]any{
+			"udpEnabled": true,
+			"udpPort":    8995,
+		}))
+		assert.Empty(t, reporter.drifts)
+
+		t.Setenv("VERIFY_PATH", "verify-secret-path")
+		secret := output
+		secret.HTTP.URL = srv.URL + "/verify-secret-path/{{.uid}}"
+		secret.HTTP.Verify = &Verify{URL: srv.URL + "/${env:VERIFY_PATH}/{{.uid}}"}
+		require.NoError(t, secret.Publish(ctx, map[string]any{"uid": "1"}, map[string]any{"udpEnabled": true}))
+		assert.Empty(t, reporter.drifts, "secrets in the verify url are resolved")
+
+		output.HTTP.Verify.URL = srv.URL + "/missing"
+		require.NoError(t, output.Publish(ctx, map[string]any{"uid": "1"}, map[string]any{"udpEnabled": true}))
+		require.Len(t, reporter.drifts, 1, "a missing target has drifted")
+	})
+
+	t.Run("skip unchanged", func(t *testing.T) {
+		srv, state := stateServer(t, nil)
+		state["/node/1"] = map[string]any{"udpEnabled": true, "udpPort": float64(8995)}
+
+		var output Output
+		output.HTTP.URL = srv.URL + "/node/{{.uid}}"
+		output.HTTP.Method = http.MethodPut
+
+		same := Item{
+			Original: map[string]any{"uid": "1"},
+			Message:  map[string]any{"udpEnabled": true, "udpPort": 8995},
+			Before:   map[string]any{"udpEnabled": true, "udpPort": 8995.0},
+		}
+		different := Item{
+			Original: map[string]any{"uid": "2"},
+			Message:  map[string]any{"udpEnabled": true},
+			Before:   map[string]any{"udpEnabled": false},
+		}
+
+		unchanged, err := output.unchanged(t.Context(), same)
+		require.NoError(t, err)
+		assert.False(t, unchanged, "nothing is skipped unless asked")
+
+		output.HTTP.SkipUnchanged = "original"
+		unchanged, err = output.unchanged(t.Context(), same)
+		require.NoError(t, err)
+		assert.True(t, unchanged)
+		unchanged, err = output.unchanged(t.Context(), different)
+		require.NoError(t, err)
+		assert.False(t, unchanged)
+
+		output.HTTP.SkipUnchanged = "fetch"
+		output.HTTP.Headers = map[string]string{"If-Match": "{{.original.etag}}", "Content-Type": "application/json"}
+		same.Before = nil
+		unchanged, err = output.unchanged(t.Context(), same)
+		require.NoError(t, err)
+		assert.True(t, unchanged)
+		unchanged, err = output.unchanged(t.Context(), different)
+		require.NoError(t, err)
+		assert.False(t, unchanged, "targets that don't exist yet have changed")
+		output.HTTP.Headers = nil
+
+		plan := Plan{Output: output, skipReporter: true}
+		plan.Output.HTTP.SkipUnchanged = "original"
+		plan.Input.Raw = `[{"uid": "1", "udpEnabled": true}, {"uid": "2", "udpEnabled": false}]`
+		plan.Pipeline.Processors = []Processor{Transform{Fields: map[string]string{"udpEnabled": "true"}}}
+		require.NoError(t, plan.Run(t.Context()))
+		assert.Equal(t, map[string]any{"uid": "2", "udpEnabled": true}, state["/node/2"])
+		assert.Equal(t, map[string]any{"udpEnabled": true, "udpPort": float64(8995)}, state["/node/1"],
+			"unchanged messages aren't published")
+	})
+
+	t.Run("patch bodies", func(t *testing.T) {
+		before := map[string]any{
+			"enabled": true,
+			"port":    8995.0,
+			"tags":    map[string]any{"a": "1", "b/c": "2"},
+			"old":     "gone",
+		}
+		after := map[string]any{
+			"enabled": true,
+			"port":    8996.0,
+			"tags":    map[string]any{"a": "1", "b/c": "3"},
+			"new":     nil,
+		}
+
+		assert.Equal(t, map[string]any{
+			"port": 8996.0,
+			"tags": map[string]any{"b/c": "3"},
+			"old":  nil,
+			"new":  nil,
+		}, mergePatch(before, after))
+
+		data, err := json.Marshal(jsonPatch(before, after))
+		require.NoError(t, err)
+		assert.JSONEq(t, `[
+			{"op": "add", "path": "/new", "value": null},
+			{"op": "remove", "path": "/old"},
+			{"op": "replace", "path": "/port", "value": 8996},
+			{"op": "replace", "path": "/tags/b~1c", "value": "3"}
+		]`, string(data))
+
+		data, err = json.Marshal(jsonPatch(before, before))
+		require.NoError(t, err)
+		assert.JSONEq(t, `[]`, string(data), "an unchanged message is an empty patch")
+
+		var contentType, body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			data, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			body = string(data)
+		}))
+		defer srv.Close()
+
+		var output Output
+		output.HTTP.URL = srv.URL + "/node/{{.uid}}"
+		output.HTTP.Method = http.MethodPatch
+		output.HTTP.Headers = map[string]string{"Content-Type": "application/json"}
+		item := Item{
+			Original: map[string]any{"uid": "1"},
+			Message:  map[string]any{"enabled": true, "port": 8996},
+			Before:   map[string]any{"enabled": true, "port": 8995},
+		}
+
+		require.NoError(t, output.PublishItem(t.Context(), item))
+		assert.Equal(t, "application/json", contentType)
+		assert.JSONEq(t, `{"enabled": true, "port": 8996}`, body)
+
+		output.HTTP.Body = "merge-patch"
+		require.NoError(t, output.PublishItem(t.Context(), item))
+		assert.Equal(t, "application/merge-patch+json", contentType)
+		assert.JSONEq(t, `{"port": 8996}`, body)
+
+		output.HTTP.Body = "json-patch"
+		require.NoError(t, output.PublishItem(t.Context(), item))
+		assert.Equal(t, "application/json-patch+json", contentType)
+		assert.JSONEq(t, `[{"op": "replace", "path": "/port", "value": 8996}]`, body)
+
+		item.Before = nil
+		require.NoError(t, output.PublishItem(t.Context(), item))
+		assert.JSONEq(t, `[
+			{"op": "add", "path": "/enabled", "value": true},
+			{"op": "add", "path": "/port", "value": 8996}
+		]`, body, "messages without a before state are diffed against nothing")
+
+		output.HTTP.Body = "yaml"
+		require.ErrorContains(t, output.PublishItem(t.Context(), item), "unknown body mode")
+	})
+
+	t.Run("templated body and headers", func(t *testing.T) {
+		var ifMatch, body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ifMatch = r.Header.Get("If-Match")
+			data, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			body = string(data)
+		}))
+		defer srv.Close()
+
+		var output Output
+		output.HTTP.URL = srv.URL + "/node/{{.uid}}"
+		output.HTTP.Method = http.MethodPut
+		output.HTTP.Headers = map[string]string{"If-Match": "{{.original.etag}}"}
+		output.HTTP.BodyTemplate = `{"node": "{{.original.uid}}", "config": {{toJSON .body}}}`
+		item := Item{
+			Original: map[string]any{"uid": "1", "etag": "abc"},
+			Message:  map[string]any{"enabled": true, "port": 8996},
+			Before:   map[string]any{"enabled": true, "port": 8995},
+		}
+
+		require.NoError(t, output.PublishItem(t.Context(), item))
+		assert.Equal(t, "abc", ifMatch)
+		assert.JSONEq(t, `{"node": "1", "config": {"enabled": true, "port": 8996}}`, body)
+
+		output.HTTP.Body = "merge-patch"
+		output.HTTP.BodyTemplate = `{"config": {{toJSON .body}}, "was": {{toJSON .processed.port}}}`
+		require.NoError(t, output.PublishItem(t.Context(), item))
+		assert.JSONEq(t, `{"config": {"port": 8996}, "was": 8996}`, body)
+
+		output.HTTP.Headers["If-Match"] = "{{.original.etag"
+		require.ErrorContains(t, output.PublishItem(t.Context(), item), "rendering header If-Match")
+	})
+
+	t.Run("files and stdout", func(t *testing.T) {
+		dir := t.TempDir()
+		var out bytes.Buffer
+		stdout = &out
+		defer func() { stdout = os.Stdout }()
+
+		plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: '[{"uid": "1", "port": 1}, {"uid": "2", "port": 2}]'
+
+outputs:
+  - name: array
+    file:
+      path: %[1]s/all.json
+      format: json
+  - name: lines
+    file:
+      path: %[1]s/all.ndjson
+  - name: each
+    file:
+      path: %[1]s/nodes/{{.uid}}.json
+      format: files
+  - name: stdout
+    stdout: true
+`, dir)))
+		require.NoError(t, err)
+		plan.skipReporter = true
+		assert.True(t, plan.UsesStdout())
+		require.NoError(t, plan.Run(t.Context()))
+
+		data, err := os.ReadFile(filepath.Join(dir, "all.json"))
+		require.NoError(t, err)
+		assert.JSONEq(t, `[{"uid": "1", "port": 1}, {"uid": "2", "port": 2}]`, string(data))
+
+		data, err = os.ReadFile(filepath.Join(dir, "all.ndjson"))
+		require.NoError(t, err)
+		assert.Equal(t, "{\"port\":1,\"uid\":\"1\"}\n{\"port\":2,\"uid\":\"2\"}\n", string(data))
+		assert.Equal(t, string(data), out.String())
+
+		data, err = os.ReadFile(filepath.Join(dir, "nodes", "2.json"))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"uid": "2", "port": 2}`, string(data))
+
+		plan.Input.Raw = "[]"
+		require.NoError(t, plan.Run(t.Context()))
+		data, err = os.ReadFile(filepath.Join(dir, "all.json"))
+		require.NoError(t, err)
+		assert.Equal(t, "[]\n", string(data), "an empty run still writes a valid array")
+
+		out.Reset()
+		plan.Input.Raw = `[{"uid": "3", "port": 3}]`
+		plan.Outputs = append(plan.Outputs, NamedOutput{Name: "exec", Output: Output{Exec: Exec{Command: "touch", Args: []string{filepath.Join(dir, "ran")}}}})
+		plan.DryRun = true
+		require.NoError(t, plan.Run(t.Context()))
+		data, err = os.ReadFile(filepath.Join(dir, "all.ndjson"))
+		require.NoError(t, err)
+		assert.Equal(t, "{\"port\":3,\"uid\":\"3\"}\n", string(data), "local outputs are written in a dry run")
+		assert.Equal(t, string(data), out.String())
+		assert.FileExists(t, filepath.Join(dir, "nodes", "3.json"))
+		assert.NoFileExists(t, filepath.Join(dir, "ran"), "commands aren't run in a dry run")
+
+		var unopened Output
+		unopened.File.Path = filepath.Join(dir, "unopened.json")
+		require.ErrorContains(t, unopened.Publish(t.Context(), nil, map[string]any{}), "isn't open")
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		tokens := 0
+		expiresIn := 3600
+		valid := map[string]bool{}
+		var authorizations []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				id, secret, ok := r.BasicAuth()
+				assert.True(t, ok)
+				assert.Equal(t, "jsoninator", id)
+				assert.Equal(t, "s3cret", secret)
+				require.NoError(t, r.ParseForm())
+				assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+				assert.Equal(t, "nodes:write nodes:read", r.PostForm.Get("scope"))
+				tokens++
+				token := fmt.Sprintf("token-%d", tokens)
+				valid[token] = true
+				fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": %d}`, token, expiresIn)
+				return
+			}
+			if r.URL.Path == "/missing" {
+				return
+			}
+
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"enabled": true}`, string(body), "retries resend the body")
+			token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if isBearer && strings.HasPrefix(token, "token-") && !valid[token] {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+		defer srv.Close()
+
+		var output Output
+		output.HTTP.URL = srv.URL + "/node/{{.uid}}"
+		output.HTTP.Method = http.MethodPut
+		output.HTTP.StatusCodes = []int{200}
+		publish := func() error {
+			return output.Publish(t.Context(), map[string]any{"uid": "1"}, map[string]any{"enabled": true})
+		}
+
+		output.HTTP.Auth = &Auth{Bearer: "static"}
+		require.NoError(t, publish())
+		output.HTTP.Auth = &Auth{Basic: &BasicAuth{Username: "user", Password: "pass"}}
+		require.NoError(t, publish())
+		assert.Equal(t, []string{"Bearer static", "Basic dXNlcjpwYXNz"}, authorizations)
+
+		authorizations = nil
+		output.HTTP.Auth = &Auth{OAuth2: &OAuth2{
+			TokenURL:     srv.URL + "/token",
+			ClientID:     "jsoninator",
+			ClientSecret: "s3cret",
+			Scopes:       []string{"nodes:write", "nodes:read"},
+		}}
+		require.NoError(t, publish())
+		require.NoError(t, publish())
+		assert.Equal(t, 1, tokens, "tokens are reused")
+
+		delete(valid, "token-1")
+		require.NoError(t, publish())
+		assert.Equal(t, 2, tokens, "a rejected token is replaced")
+		assert.Equal(t, []string{"Bearer token-1", "Bearer token-1", "Bearer token-1", "Bearer token-2"}, authorizations)
+
+		expiresIn = 10
+		delete(valid, "token-2")
+		require.NoError(t, publish())
+		require.NoError(t, publish())
+		assert.Equal(t, 4, tokens, "tokens that are about to expire are replaced")
+
+		output.HTTP.Auth.OAuth2.TokenURL = srv.URL + "/missing"
+		output.HTTP.Auth.OAuth2.token = ""
+		require.ErrorContains(t, publish(), "authenticating: parsing token response")
+	})
+}
@@ -0,0 +1,107 @@
+package plan
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// mergePatch computes a JSON Merge Patch (RFC 7396) that turns before into
+// after. Objects are diffed field by field, and anything else that differs is
+// replaced outright. Like any merge patch, it can't set a field to null, since
+// null means the field is removed.
+func mergePatch(before, after Message) Message {
+	b, bok := before.(map[string]any)
+	a, aok := after.(map[string]any)
+	if !bok || !aok {
+		return after
+	}
+
+	patch := make(map[string]any)
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, v := range a {
+		old, ok := b[k]
+		switch {
+		case !ok:
+			patch[k] = v
+		case reflect.DeepEqual(old, v):
+		default:
+			if _, isMap := v.(map[string]any); isMap {
+				patch[k] = mergePatch(old, v)
+			} else {
+				patch[k] = v
+			}
+		}
+	}
+	return patch
+}
+
+// patchOp is a single JSON Patch operation.
+type patchOp struct {
+	Op    string
+	Path  string
+	Value any
+}
+
+// MarshalJSON implements json.Marshaler for patchOp. Values can legitimately
+// be null, so value is left out based on the operation rather than omitempty.
+func (op patchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(map[string]any{"op": op.Op, "path": op.Path})
+	}
+	return json.Marshal(map[string]any{"op": op.Op, "path": op.Path, "value": op.Value})
+}
+
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// jsonPatch computes a JSON Patch (RFC 6902) that turns before into after.
+// Objects are diffed field by field, and anything else that differs is
+// replaced outright. Operations are sorted by path so patches are stable. A
+// patch that changes nothing is an empty array, never null.
+func jsonPatch(before, after Message) []patchOp {
+	return appendJSONPatch([]patchOp{}, "", before, after)
+}
+
+func appendJSONPatch(ops []patchOp, path string, before, after Message) []patchOp {
+	b, bok := before.(map[string]any)
+	a, aok := after.(map[string]any)
+	if !bok || !aok {
+		if !reflect.DeepEqual(before, after) {
+			ops = append(ops, patchOp{Op: "replace", Path: path, Value: after})
+		}
+		return ops
+	}
+
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		p := path + "/" + escapePointer(k)
+		old, inBefore := b[k]
+		v, inAfter := a[k]
+		switch {
+		case !inAfter:
+			ops = append(ops, patchOp{Op: "remove", Path: p})
+		case !inBefore:
+			ops = append(ops, patchOp{Op: "add", Path: p, Value: v})
+		default:
+			ops = appendJSONPatch(ops, p, old, v)
+		}
+	}
+	return ops
+}
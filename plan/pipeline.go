@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log/slog"
 	"strings"
+	"sync"
 	"text/template"
 
 	"gopkg.in/yaml.v3"
@@ -59,6 +60,69 @@ func (p *Pipeline) UnmarshalYAML(value *yaml.Node) error {
 					return fmt.Errorf("unmarshaling map processor: %w", err)
 				}
 				proc = m
+			case "split":
+				var sp Split
+				if err := procConfig.Decode(&sp); err != nil {
+					return fmt.Errorf("unmarshaling split processor: %w", err)
+				}
+				proc = sp
+			case "group_by":
+				var g GroupBy
+				if err := procConfig.Decode(&g); err != nil {
+					return fmt.Errorf("unmarshaling group_by processor: %w", err)
+				}
+				if err := g.check(); err != nil {
+					return fmt.Errorf("group_by processor: %w", err)
+				}
+				proc = g
+			case "dedupe":
+				var d Dedupe
+				if err := procConfig.Decode(&d); err != nil {
+					return fmt.Errorf("unmarshaling dedupe processor: %w", err)
+				}
+				proc = d
+			case "sort":
+				var so Sort
+				if err := procConfig.Decode(&so); err != nil {
+					return fmt.Errorf("unmarshaling sort processor: %w", err)
+				}
+				proc = so
+			case "limit":
+				var l Limit
+				if err := procConfig.Decode(&l); err != nil {
+					return fmt.Errorf("unmarshaling limit processor: %w", err)
+				}
+				if err := l.check(); err != nil {
+					return fmt.Errorf("limit processor: %w", err)
+				}
+				proc = l
+			case "sample":
+				var sa Sample
+				if err := procConfig.Decode(&sa); err != nil {
+					return fmt.Errorf("unmarshaling sample processor: %w", err)
+				}
+				if err := sa.check(); err != nil {
+					return fmt.Errorf("sample processor: %w", err)
+				}
+				proc = sa
+			case "lookup":
+				var l Lookup
+				if err := procConfig.Decode(&l); err != nil {
+					return fmt.Errorf("unmarshaling lookup processor: %w", err)
+				}
+				if err := l.load(); err != nil {
+					return fmt.Errorf("loading lookup processor: %w", err)
+				}
+				proc = l
+			case "http_lookup":
+				h := HTTPLookup{cache: &sync.Map{}}
+				if err := procConfig.Decode(&h); err != nil {
+					return fmt.Errorf("unmarshaling http_lookup processor: %w", err)
+				}
+				if h.Into == "" {
+					return fmt.Errorf("http_lookup processor requires into")
+				}
+				proc = h
 			default:
 				return fmt.Errorf("unknown processor type: %s", procType)
 			}
@@ -81,31 +145,313 @@ func deepCopy(data Message) (Message, error) {
 	return msg, nil
 }
 
-// Process runs a message through all processors in the pipeline in order.
-// If a processor returns nil, processing stops and nil is returned.
-func (p Pipeline) Process(ctx context.Context, data Message) (Message, error) {
-	data, err := deepCopy(data)
+// Item is a message that made it through the pipeline, along with the message
+// output templates use as their data context.
+type Item struct {
+	Original Message
+	Message  Message
+	// Before is the message as it was before the pipeline changed it: the
+	// input message, or the result of the last map or split processor. It's
+	// nil for messages created by the pipeline, such as groups.
+	Before Message
+
+	reporter *Reporter
+	// child is set for messages split from another. They share their input's
+	// reporter, but record what the pipeline does to them on a reporter of
+	// their own first, so one child being filtered doesn't filter the rest.
+	child bool
+}
+
+// newItem prepares an input message to run through the pipeline as part of a
+// stream, with its own reporter.
+func newItem(msg Message) (Item, error) {
+	copied, err := deepCopy(msg)
 	if err != nil {
-		return nil, fmt.Errorf("making deep copy of message: %w", err)
+		return Item{}, fmt.Errorf("making deep copy of message: %w", err)
 	}
-	for _, processor := range p.Processors {
-		var err error
+	return Item{Original: msg, Message: copied, Before: msg, reporter: NewReporter(id(msg))}, nil
+}
+
+// parentKey is the field fanned out messages use to reference the message
+// they were split from in output templates.
+const parentKey = "_parent"
+
+// childItem builds the item for a message emitted by a MultiProcessor. Output
+// templates for the child see the emitted message with its parent's original
+// under parentKey; if the emitted message isn't an object, it's under "value".
+func childItem(parent Item, msg Message) (Item, error) {
+	copied, err := deepCopy(msg)
+	if err != nil {
+		return Item{}, fmt.Errorf("making deep copy of message: %w", err)
+	}
+
+	original, ok := copied.(map[string]any)
+	if !ok {
+		original = map[string]any{"value": copied}
+	}
+	original[parentKey] = parent.Original
+
+	before, err := deepCopy(msg)
+	if err != nil {
+		return Item{}, fmt.Errorf("making deep copy of message: %w", err)
+	}
+
+	return Item{Original: original, Message: msg, Before: before, reporter: parent.reporter, child: true}, nil
+}
+
+// processItem runs an item through processors. A child item is run with a
+// reporter of its own, which is then adopted by its input's reporter.
+func processItem(ctx context.Context, processors []Processor, item Item) ([]Item, error) {
+	if !item.child || item.reporter == nil {
+		return runProcessors(ctx, processors, item)
+	}
+	reporter := NewReporter(item.reporter.name)
+	items, err := runProcessors(context.WithValue(ctx, reporterKey, reporter), processors, item)
+	if err != nil {
+		return nil, err
+	}
+	item.reporter.adopt(reporter, childName(item.Message))
+	return items, nil
+}
+
+// childName identifies a split message in reports, by its id if it has one,
+// or else as JSON.
+func childName(msg Message) string {
+	if m, ok := msg.(map[string]any); ok {
+		for _, k := range []string{"fqdn", "uid", "name", "id"} {
+			if _, ok := m[k]; ok {
+				return id(m)
+			}
+		}
+	}
+	return describe(msg)
+}
+
+func runProcessors(ctx context.Context, processors []Processor, item Item) ([]Item, error) {
+	for i, processor := range processors {
 		slog.Info("running processor", "type", fmt.Sprintf("%T", processor))
-		data, err = processor.Process(ctx, data)
+
+		if mp, ok := processor.(MultiProcessor); ok {
+			msgs, err := mp.ProcessMulti(ctx, item.Message)
+			if err != nil {
+				return nil, err
+			}
+			var items []Item
+			for _, msg := range msgs {
+				child, err := childItem(item, msg)
+				if err != nil {
+					return nil, err
+				}
+				processed, err := processItem(ctx, processors[i+1:], child)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, processed...)
+			}
+			return items, nil
+		}
+
+		var err error
+		item.Message, err = processor.Process(ctx, item.Message)
 		switch {
 		case err != nil:
 			return nil, err
-		case data == nil:
+		case item.Message == nil:
 			return nil, nil
 		}
+
+		// Map narrows the message down to what will be published, so what it
+		// selected is the state before any later processors change it.
+		if _, ok := processor.(Map); ok {
+			if item.Before, err = deepCopy(item.Message); err != nil {
+				return nil, fmt.Errorf("making deep copy of message: %w", err)
+			}
+		}
 	}
-	return data, nil
+	return []Item{item}, nil
+}
+
+// newItems prepares input messages to run through the pipeline as a stream.
+func newItems(msgs []Message) ([]Item, error) {
+	items := make([]Item, 0, len(msgs))
+	for _, msg := range msgs {
+		fmt.Fprintln(Progress, "Processing", id(msg))
+		item, err := newItem(msg)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// batch tracks the reporters of every item in a stream, so each is closed
+// exactly once after the stream has been processed and published.
+type batch struct {
+	reporters []*Reporter
+	seen      map[*Reporter]bool
+}
+
+func (b *batch) track(items ...Item) {
+	if b.seen == nil {
+		b.seen = make(map[*Reporter]bool)
+	}
+	for _, item := range items {
+		if item.reporter != nil && !b.seen[item.reporter] {
+			b.seen[item.reporter] = true
+			b.reporters = append(b.reporters, item.reporter)
+		}
+	}
+}
+
+// lastUses returns the index of the last item that uses each reporter, so a
+// reporter can be closed, and its checkpoint written, as soon as that item is
+// done. Messages split from the same input share a reporter. Reporters for
+// messages that didn't make it through the stream are closed straight away.
+func (b *batch) lastUses(items []Item) map[*Reporter]int {
+	last := make(map[*Reporter]int, len(items))
+	for i, item := range items {
+		if item.reporter != nil {
+			last[item.reporter] = i
+		}
+	}
+	for _, r := range b.reporters {
+		if _, ok := last[r]; !ok {
+			r.Close()
+		}
+	}
+	return last
+}
+
+// close closes every reporter in the batch. If the run was interrupted,
+// reporters for messages that never finished are discarded instead, so they
+// aren't reported as no-ops.
+func (b *batch) close(ctx context.Context) {
+	for _, r := range b.reporters {
+		if ctx.Err() != nil && r.outcome() == "" {
+			r.discard()
+		}
+		r.Close()
+	}
+}
+
+// processEach runs each item through processors that don't need to see the
+// whole stream, with the item's reporter in context.
+func processEach(ctx context.Context, processors []Processor, items []Item) ([]Item, error) {
+	if len(processors) == 0 {
+		return items, nil
+	}
+
+	var out []Item
+	for i, item := range items {
+		if ctx.Err() != nil {
+			return nil, interrupted(ctx, items[i:])
+		}
+		// Like in a plan's run, once a message has started it's allowed to
+		// finish, even if the run is interrupted.
+		ictx := context.WithoutCancel(ctx)
+		if item.reporter != nil {
+			ictx = context.WithValue(ictx, reporterKey, item.reporter)
+		}
+		processed, err := processItem(ictx, processors, item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, processed...)
+	}
+	return out, nil
+}
+
+// processStream runs a stream of items through processors. Stages act as
+// barriers: every item is run through the processors before a stage, then the
+// stage sees all of the survivors at once.
+func (b *batch) processStream(ctx context.Context, processors []Processor, items []Item) ([]Item, error) {
+	b.track(items...)
+
+	start := 0
+	for i, processor := range processors {
+		stage, ok := processor.(Stage)
+		if !ok {
+			continue
+		}
+
+		var err error
+		items, err = processEach(ctx, processors[start:i], items)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("running stage", "type", fmt.Sprintf("%T", processor), "messages", len(items))
+		items, err = stage.ProcessStream(ctx, items)
+		if err != nil {
+			return nil, err
+		}
+		b.track(items...)
+		start = i + 1
+	}
+
+	return processEach(ctx, processors[start:], items)
+}
+
+// lastStage returns the index of the last Stage in the pipeline, or -1 if
+// there are none.
+func (p Pipeline) lastStage() int {
+	last := -1
+	for i, processor := range p.Processors {
+		if _, ok := processor.(Stage); ok {
+			last = i
+		}
+	}
+	return last
+}
+
+// ProcessAll runs a message through all processors in the pipeline in order,
+// returning every message that made it to the end. Processors that implement
+// MultiProcessor may fan a message out into many, in which case the remaining
+// processors run on each of them.
+func (p Pipeline) ProcessAll(ctx context.Context, data Message) ([]Item, error) {
+	copied, err := deepCopy(data)
+	if err != nil {
+		return nil, fmt.Errorf("making deep copy of message: %w", err)
+	}
+	reporter, _ := ctx.Value(reporterKey).(*Reporter)
+	return processItem(ctx, p.Processors, Item{Original: data, Message: copied, Before: data, reporter: reporter})
+}
+
+// Process runs a message through all processors in the pipeline in order.
+// If a processor returns nil, processing stops and nil is returned. It's an
+// error for the pipeline to emit more than one message; use ProcessAll for
+// pipelines that fan out.
+func (p Pipeline) Process(ctx context.Context, data Message) (Message, error) {
+	items, err := p.ProcessAll(ctx, data)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(items) == 0:
+		return nil, nil
+	case len(items) > 1:
+		return nil, fmt.Errorf("pipeline emitted %d messages, expected at most one", len(items))
+	}
+	return items[0].Message, nil
 }
 
 type Processor interface {
 	Process(ctx context.Context, msg Message) (Message, error)
 }
 
+// MultiProcessor is implemented by processors that can emit zero, one or many
+// messages for each message they receive. Pipelines prefer ProcessMulti over
+// Process when a processor implements both.
+type MultiProcessor interface {
+	ProcessMulti(ctx context.Context, msg Message) ([]Message, error)
+}
+
+// Stage is implemented by processors that operate on every message at once
+// rather than one at a time, such as group_by. When a plan runs, a stage is a
+// barrier: all messages must reach it before any continue past it.
+type Stage interface {
+	ProcessStream(ctx context.Context, items []Item) ([]Item, error)
+}
+
 // Transform modifies targeted fields in a message using Go templates.
 type Transform struct {
 	Fields map[string]string `yaml:"fields"`
@@ -194,108 +540,161 @@ var templateFuncs = template.FuncMap{
 	"hasPrefix": strings.HasPrefix,
 	"hasSuffix": strings.HasSuffix,
 	"contains":  strings.Contains,
+	"toJSON":    toJSON,
+}
+
+// toJSON renders a value as JSON, for templates that build JSON documents.
+func toJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
 
 // Filter conditionally allows messages to continue through the pipeline based on
 // prefix/suffix matching and/or a Go template query that evaluates to "true".
+// Criteria can be combined with nested any/all/not blocks, each of which holds
+// further filters.
 type Filter struct {
 	Prefix map[string]string `yaml:"prefix"`
 	Suffix map[string]string `yaml:"suffix"`
 	Query  string            `yaml:"query"`
+	Any    []Filter          `yaml:"any"`
+	All    []Filter          `yaml:"all"`
+	Not    *Filter           `yaml:"not"`
 }
 
-func (f Filter) suffixesMatch(ctx context.Context, data Message) bool {
-	if f.Suffix == nil {
-		return true
-	}
-	reporter, ok := ctx.Value(reporterKey).(*Reporter)
-	if !ok {
-		slog.Error("filter processor requires reporter in context - this is a bug in jsoninator")
-		return false
-	}
-
+// suffixesMatch, prefixesMatch and queryMatches return the reason a message
+// failed the check, or an empty string if it passed.
+func (f Filter) suffixesMatch(data Message) string {
 	for k, v := range f.Suffix {
 		test, ok := dive(data, strings.Split(k, "."))
 		if !ok {
-			reporter.Skip(fmt.Sprintf("missing field %q for suffix check", k))
-			return false
+			return fmt.Sprintf("missing field %q for suffix check", k)
 		}
 		if s, ok := test.(string); !ok || !strings.HasSuffix(s, v) {
-			reporter.Skip(fmt.Sprintf("field %q does not have suffix %q", k, v))
-			return false
+			return fmt.Sprintf("field %q does not have suffix %q", k, v)
 		}
 	}
 
-	return true
+	return ""
 }
 
-func (f Filter) prefixesMatch(ctx context.Context, data Message) bool {
-	if f.Prefix == nil {
-		return true
-	}
-	reporter, ok := ctx.Value(reporterKey).(*Reporter)
-	if !ok {
-		slog.Error("filter processor requires reporter in context - this is a bug in jsoninator")
-		return false
-	}
-
+func (f Filter) prefixesMatch(data Message) string {
 	for k, v := range f.Prefix {
 		test, ok := dive(data, strings.Split(k, "."))
 		if !ok {
-			reporter.Skip(fmt.Sprintf("missing field %q for prefix check", k))
-			return false
+			return fmt.Sprintf("missing field %q for prefix check", k)
 		}
 		if s, ok := test.(string); !ok || !strings.HasPrefix(s, v) {
-			reporter.Skip(fmt.Sprintf("field %q does not have prefix %q", k, v))
-			return false
+			return fmt.Sprintf("field %q does not have prefix %q", k, v)
 		}
 	}
 
-	return true
+	return ""
 }
 
-func (f Filter) queryMatches(ctx context.Context, data Message) bool {
+func (f Filter) queryMatches(data Message) string {
 	if f.Query == "" {
-		return true
-	}
-	reporter, ok := ctx.Value(reporterKey).(*Reporter)
-	if !ok {
-		slog.Error("filter processor requires reporter in context - this is a bug in jsoninator")
-		return false
+		return ""
 	}
 
 	tmpl, err := template.New("filter").Funcs(templateFuncs).Parse(f.Query)
 	if err != nil {
-		slog.Error("unable to parse query template '%s': %v", f.Query, err)
-		return false
+		slog.Error("unable to parse query template", "query", f.Query, "err", err)
+		return fmt.Sprintf("query %q could not be parsed: %v", f.Query, err)
 	}
 
 	var out bytes.Buffer
 	if err := tmpl.Execute(&out, data); err != nil {
-		slog.Error("unable to execute query template '%s': %v", f.Query, err)
-		return false
+		slog.Error("unable to execute query template", "query", f.Query, "err", err)
+		return fmt.Sprintf("query %q could not be executed: %v", f.Query, err)
 	}
 
 	result := strings.TrimSpace(out.String())
 	if result != "true" {
-		reporter.Skip(fmt.Sprintf("query %q evaluated to %q", f.Query, result))
-		return false
+		return fmt.Sprintf("query %q evaluated to %q", f.Query, result)
 	}
 
-	return true
+	return ""
+}
+
+// anyMatches passes if at least one of the nested filters passes. When none
+// do, the reason lists why each branch failed.
+func (f Filter) anyMatches(data Message) string {
+	if len(f.Any) == 0 {
+		return ""
+	}
+
+	reasons := make([]string, 0, len(f.Any))
+	for i, sub := range f.Any {
+		reason := sub.match(data)
+		if reason == "" {
+			return ""
+		}
+		reasons = append(reasons, fmt.Sprintf("any[%d]: %s", i, reason))
+	}
+
+	return fmt.Sprintf("no branch of any matched (%s)", strings.Join(reasons, "; "))
+}
+
+func (f Filter) allMatch(data Message) string {
+	for i, sub := range f.All {
+		if reason := sub.match(data); reason != "" {
+			return fmt.Sprintf("all[%d]: %s", i, reason)
+		}
+	}
+
+	return ""
+}
+
+func (f Filter) notMatches(data Message) string {
+	if f.Not == nil {
+		return ""
+	}
+	if f.Not.match(data) == "" {
+		return "not: nested filter matched"
+	}
+
+	return ""
+}
+
+// match evaluates every criteria of the filter, returning the reason for the
+// first one that fails, or an empty string if the message passes.
+func (f Filter) match(data Message) string {
+	checks := []func(Message) string{
+		f.prefixesMatch,
+		f.suffixesMatch,
+		f.queryMatches,
+		f.anyMatches,
+		f.allMatch,
+		f.notMatches,
+	}
+	for _, check := range checks {
+		if reason := check(data); reason != "" {
+			return reason
+		}
+	}
+
+	return ""
 }
 
 // Process implements the Processor interface for Filter. Messages are evaluated
 // against each of the filter's criteria, and if they pass all, the original message is
 // returned. If any criteria are not met, nil is returned. Empty criteria are ignored.
 func (f Filter) Process(ctx context.Context, data Message) (Message, error) {
-	if f.prefixesMatch(ctx, data) &&
-		f.suffixesMatch(ctx, data) &&
-		f.queryMatches(ctx, data) {
-		return data, nil
+	reporter, ok := ctx.Value(reporterKey).(*Reporter)
+	if !ok {
+		return nil, fmt.Errorf("filter processor requires reporter in context")
+	}
+
+	if reason := f.match(data); reason != "" {
+		reporter.Skip(reason)
+		return nil, nil
 	}
 
-	return nil, nil
+	return data, nil
 }
 
 // Map rewrites a message to be the value of a specified field, optionally
@@ -338,3 +737,57 @@ func (m Map) Process(ctx context.Context, data Message) (Message, error) {
 
 	return msg, nil
 }
+
+// Split fans a message out into one message per element of an array field.
+type Split struct {
+	// Field is the dot path of the array to split. If it's empty, the message
+	// itself must be an array.
+	Field string `yaml:"field"`
+}
+
+// ProcessMulti implements the MultiProcessor interface for Split. A missing or
+// empty array emits no messages, and the message is recorded as filtered.
+func (s Split) ProcessMulti(ctx context.Context, data Message) ([]Message, error) {
+	reporter, ok := ctx.Value(reporterKey).(*Reporter)
+	if !ok {
+		return nil, fmt.Errorf("split processor requires reporter in context")
+	}
+
+	v := data
+	if s.Field != "" {
+		v, ok = dive(data, strings.Split(s.Field, "."))
+		if !ok {
+			reporter.Skip(fmt.Sprintf("missing field %q for split", s.Field))
+			return nil, nil
+		}
+	}
+
+	elems, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("split processor expects field %q to be an array, got %T", s.Field, v)
+	}
+	if len(elems) == 0 {
+		reporter.Skip(fmt.Sprintf("field %q is empty", s.Field))
+	}
+
+	msgs := make([]Message, 0, len(elems))
+	for _, elem := range elems {
+		msgs = append(msgs, elem)
+	}
+	return msgs, nil
+}
+
+// Process implements the Processor interface for Split, so it can be used as
+// a pipeline processor. It only succeeds if the split emits at most one message.
+func (s Split) Process(ctx context.Context, data Message) (Message, error) {
+	msgs, err := s.ProcessMulti(ctx, data)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(msgs) == 0:
+		return nil, nil
+	case len(msgs) > 1:
+		return nil, fmt.Errorf("split emitted %d messages, expected at most one", len(msgs))
+	}
+	return msgs[0], nil
+}
@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -244,6 +249,58 @@ func Test_Pipeline(t *testing.T) {
 				require.Nil(t, msg)
 			})
 		})
+		t.Run("boolean composition", func(t *testing.T) {
+			var pipeline Pipeline
+			require.NoError(t, yaml.Unmarshal(yamlify(`
+				processors:
+					- filter:
+							any:
+								- suffix:
+										name: oozle
+								- prefix:
+										city: Boise
+							not:
+								all:
+									- prefix:
+											name: fiz
+									- query: |
+											{{if eq .protocol "udp"}}true{{end}}
+				`), &pipeline))
+
+			for _, input := range inputs {
+				t.Run("filtering "+fmt.Sprint(input), func(t *testing.T) {
+					ctx, cancel := WithReporter(t.Context(), "test")
+					defer cancel()
+					output, err := pipeline.Process(ctx, input)
+					require.NoError(t, err)
+					if input["name"] == "fizboozle" {
+						require.Nil(t, output)
+					} else {
+						require.NotNil(t, output)
+					}
+				})
+			}
+		})
+
+		t.Run("skip reasons name the failing branch", func(t *testing.T) {
+			processor := Filter{
+				Any: []Filter{
+					{Prefix: map[string]string{"name": "fiz"}},
+					{Suffix: map[string]string{"city": "Angeles"}},
+				},
+			}
+
+			reason := processor.match(inputs[1])
+			assert.Contains(t, reason, `any[0]: field "name" does not have prefix "fiz"`)
+			assert.Contains(t, reason, `any[1]: field "city" does not have suffix "Angeles"`)
+
+			processor = Filter{Not: &Filter{Prefix: map[string]string{"name": "bam"}}}
+			assert.Equal(t, "not: nested filter matched", processor.match(inputs[0]))
+			assert.Empty(t, processor.match(inputs[2]))
+
+			processor = Filter{All: []Filter{{}, {Query: `{{.port}}`}}}
+			assert.Equal(t, `all[1]: query "{{.port}}" evaluated to "80"`, processor.match(inputs[0]))
+		})
 	})
 
 	t.Run("replace", func(t *testing.T) {
@@ -395,6 +452,376 @@ func Test_Pipeline(t *testing.T) {
 		})
 	})
 
+	t.Run("split", func(t *testing.T) {
+		var pipeline Pipeline
+		require.NoError(t, yaml.Unmarshal(yamlify(`
+		processors:
+			- split:
+					field: config.network.interfaces
+			- filter:
+					prefix:
+						nic: eth
+			- transform:
+					fields:
+						mtu: 9000
+				`), &pipeline))
+
+		node := map[string]any{
+			"uid": "node1",
+			"config": map[string]any{
+				"network": map[string]any{
+					"interfaces": []any{
+						map[string]any{"nic": "eth0", "mtu": 1500},
+						map[string]any{"nic": "lo", "mtu": 65536},
+						map[string]any{"nic": "eth1", "mtu": 1500},
+					},
+				},
+			},
+		}
+
+		ctx, cancel := WithReporter(t.Context(), "test")
+		defer cancel()
+		items, err := pipeline.ProcessAll(ctx, node)
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		reporter := ctx.Value(reporterKey).(*Reporter)
+		assert.Empty(t, reporter.skipped, "one filtered child doesn't filter the others")
+		assert.Equal(t, []childSkip{{name: `{"mtu":65536,"nic":"lo"}`, reason: `field "nic" does not have prefix "eth"`}}, reporter.childSkips)
+		assert.Len(t, reporter.changes, 2, "changes to the children that made it through are kept")
+		for i, nic := range []string{"eth0", "eth1"} {
+			assert.Equal(t, map[string]any{"nic": nic, "mtu": float64(9000)}, items[i].Message)
+			original, ok := items[i].Original.(map[string]any)
+			require.True(t, ok)
+			assert.Equal(t, nic, original["nic"])
+			assert.Equal(t, node, original["_parent"])
+		}
+
+		_, err = pipeline.Process(ctx, node)
+		require.Error(t, err, "process can't return more than one message")
+
+		items, err = pipeline.ProcessAll(ctx, map[string]any{"uid": "node2"})
+		require.NoError(t, err)
+		assert.Empty(t, items)
+
+		items, err = Pipeline{Processors: []Processor{Split{}}}.ProcessAll(ctx, []any{"a", "b"})
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		assert.Equal(t, map[string]any{"value": "b", "_parent": []any{"a", "b"}}, items[1].Original)
+	})
+
+	t.Run("group_by", func(t *testing.T) {
+		var pipeline Pipeline
+		require.NoError(t, yaml.Unmarshal(yamlify(`
+		processors:
+			- group_by:
+					key: "{{.cluster}}"
+					fields:
+						uids:
+							op: collect
+							field: uid
+						nodes:
+							op: count
+						mbps:
+							op: sum
+							field: mbps
+						first:
+							op: first
+							field: uid
+						last:
+							op: last
+							field: uid
+			- filter:
+					query: |
+						{{if gt .nodes 1.0}}true{{end}}
+				`), &pipeline))
+
+		var items []Item
+		for _, msg := range []map[string]any{
+			{"uid": "a", "cluster": "east", "mbps": 10.0},
+			{"uid": "b", "cluster": "west", "mbps": 5.0},
+			{"uid": "c", "cluster": "east", "mbps": 2.5},
+		} {
+			item, err := newItem(msg)
+			require.NoError(t, err)
+			items = append(items, item)
+		}
+
+		var b batch
+		out, err := b.processStream(t.Context(), pipeline.Processors, items)
+		require.NoError(t, err)
+		require.Len(t, out, 1)
+		assert.Equal(t, map[string]any{
+			"key":   "east",
+			"uids":  []any{"a", "c"},
+			"nodes": float64(2),
+			"mbps":  12.5,
+			"first": "a",
+			"last":  "c",
+		}, out[0].Message)
+		assert.Equal(t, out[0].Message, out[0].Original)
+		assert.Len(t, b.reporters, 5, "input and group reporters are tracked")
+
+		_, err = GroupBy{Key: "{{.cluster}}", Fields: map[string]Reducer{"x": {Op: "sum", Field: "uid"}}}.
+			ProcessStream(t.Context(), items)
+		require.ErrorContains(t, err, "is not a number")
+
+		for config, want := range map[string]string{
+			`{key: "{{.cluster}}", fields: {x: {op: avg}}}`: `field "x": unknown reducer "avg"`,
+			`{key: "{{.cluster"}`:                           "parsing key template",
+		} {
+			var pipeline Pipeline
+			err := yaml.Unmarshal(yamlify(`
+		processors:
+			- group_by: `+config), &pipeline)
+			assert.ErrorContains(t, err, want, config)
+		}
+	})
+
+	t.Run("stream stages", func(t *testing.T) {
+		names := func(items []Item) []any {
+			var out []any
+			for _, item := range items {
+				out = append(out, item.Message.(map[string]any)["name"])
+			}
+			return out
+		}
+		newItems := func(t *testing.T) []Item {
+			var items []Item
+			for _, msg := range []map[string]any{
+				{"uid": "1", "name": "gw-c", "port": 10.0},
+				{"uid": "2", "name": "gw-a", "port": 9.0},
+				{"uid": "1", "name": "gw-c", "port": 10.0},
+				{"uid": "3", "name": "gw-d", "port": 100.0},
+				{"uid": "4", "name": "gw-b", "port": 8.0},
+			} {
+				item, err := newItem(msg)
+				require.NoError(t, err)
+				items = append(items, item)
+			}
+			return items
+		}
+
+		t.Run("dedupe, sort and limit", func(t *testing.T) {
+			var pipeline Pipeline
+			require.NoError(t, yaml.Unmarshal(yamlify(`
+		processors:
+			- dedupe:
+					key: "{{.uid}}"
+			- sort:
+					key: "{{.name}}"
+			- limit:
+					count: 2
+					offset: 1
+				`), &pipeline))
+
+			items := newItems(t)
+			var b batch
+			out, err := b.processStream(t.Context(), pipeline.Processors, items)
+			require.NoError(t, err)
+			assert.Equal(t, []any{"gw-b", "gw-c"}, names(out))
+			assert.Equal(t, `duplicate of key "1"`, items[2].reporter.skipped)
+			assert.Equal(t, "outside of limit 2 with offset 1", items[1].reporter.skipped)
+			assert.Empty(t, items[0].reporter.skipped)
+
+			last := b.lastUses(out)
+			assert.Equal(t, map[*Reporter]int{items[4].reporter: 0, items[0].reporter: 1}, last)
+			assert.True(t, items[1].reporter.closed, "filtered messages are reported straight away")
+			assert.True(t, items[2].reporter.closed)
+			assert.False(t, items[0].reporter.closed, "kept messages are reported once they're published")
+		})
+
+		t.Run("numeric descending sort", func(t *testing.T) {
+			out, err := Sort{Key: "{{.port}}", Descending: true}.ProcessStream(t.Context(), newItems(t))
+			require.NoError(t, err)
+			assert.Equal(t, []any{"gw-d", "gw-c", "gw-c", "gw-a", "gw-b"}, names(out))
+		})
+
+		t.Run("sample is reproducible", func(t *testing.T) {
+			sample := Sample{Percent: 40, Seed: 7}
+			first, err := sample.ProcessStream(t.Context(), newItems(t))
+			require.NoError(t, err)
+			require.Len(t, first, 2)
+			second, err := sample.ProcessStream(t.Context(), newItems(t))
+			require.NoError(t, err)
+			assert.Equal(t, names(first), names(second))
+
+			all, err := Sample{Count: 10}.ProcessStream(t.Context(), newItems(t))
+			require.NoError(t, err)
+			assert.Len(t, all, 5)
+		})
+
+		t.Run("sample needs one of count or percent", func(t *testing.T) {
+			for _, sample := range []string{"{seed: 7}", "{count: 2, percent: 10}", "{percent: 0}", "{percent: 150}", "{count: -1}"} {
+				var pipeline Pipeline
+				err := yaml.Unmarshal(yamlify(`
+		processors:
+			- sample: `+sample), &pipeline)
+				assert.ErrorContains(t, err, "sample processor", sample)
+			}
+
+			_, err := Sample{}.ProcessStream(t.Context(), newItems(t))
+			assert.Error(t, err)
+		})
+
+		t.Run("limit rejects negative values", func(t *testing.T) {
+			for _, limit := range []string{"{count: -1}", "{count: 2, offset: -1}"} {
+				var pipeline Pipeline
+				err := yaml.Unmarshal(yamlify(`
+		processors:
+			- limit: `+limit), &pipeline)
+				assert.ErrorContains(t, err, "limit processor", limit)
+			}
+
+			_, err := Limit{Count: -1}.ProcessStream(t.Context(), newItems(t))
+			assert.Error(t, err)
+		})
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		t.Run("merges csv row", func(t *testing.T) {
+			var pipeline Pipeline
+			require.NoError(t, yaml.Unmarshal(yamlify(`
+		processors:
+			- lookup:
+					file: testdata/ports.csv
+					key: name
+				`), &pipeline))
+
+			ctx, cancel := WithReporter(t.Context(), "test")
+			defer cancel()
+			output, err := pipeline.Process(ctx, map[string]any{"name": "gw-denver", "udpPort": 1})
+			require.NoError(t, err)
+			res, ok := output.(map[string]any)
+			require.True(t, ok)
+			assert.Equal(t, float64(9000), res["udpPort"])
+			assert.Equal(t, "Denver", res["site"])
+		})
+
+		t.Run("attaches yaml row for later templates", func(t *testing.T) {
+			var pipeline Pipeline
+			require.NoError(t, yaml.Unmarshal(yamlify(`
+		processors:
+			- lookup:
+					file: testdata/ports.yaml
+					key: node.name
+					column: name
+					into: row
+			- transform:
+					fields:
+						udpPort: "{{.row.udpPort}}"
+			- transform:
+					fields:
+						row: nil
+				`), &pipeline))
+
+			ctx, cancel := WithReporter(t.Context(), "test")
+			defer cancel()
+			output, err := pipeline.Process(ctx, map[string]any{"node": map[string]any{"name": "gw-austin"}})
+			require.NoError(t, err)
+			res, ok := output.(map[string]any)
+			require.True(t, ok)
+			assert.Equal(t, float64(8995), res["udpPort"])
+			_, exists := res["row"]
+			assert.False(t, exists)
+		})
+
+		t.Run("misses", func(t *testing.T) {
+			processor := Lookup{File: "testdata/ports.csv", Key: "name"}
+			require.NoError(t, processor.load())
+			ctx, cancel := WithReporter(t.Context(), "test")
+			defer cancel()
+
+			output, err := processor.Process(ctx, map[string]any{"name": "gw-nowhere"})
+			require.NoError(t, err)
+			assert.Equal(t, map[string]any{"name": "gw-nowhere"}, output)
+
+			processor.OnMiss = "drop"
+			output, err = processor.Process(ctx, map[string]any{"name": "gw-nowhere"})
+			require.NoError(t, err)
+			assert.Nil(t, output)
+
+			processor.OnMiss = "error"
+			_, err = processor.Process(ctx, map[string]any{"name": "gw-nowhere"})
+			require.Error(t, err)
+		})
+
+		t.Run("rejects bad tables and settings", func(t *testing.T) {
+			var pipeline Pipeline
+			err := yaml.Unmarshal(yamlify(`
+		processors:
+			- lookup:
+					file: testdata/ports.csv
+					key: name
+					on_miss: fial
+				`), &pipeline)
+			require.ErrorContains(t, err, `unknown on_miss "fial"`)
+
+			table := filepath.Join(t.TempDir(), "dupes.csv")
+			require.NoError(t, os.WriteFile(table, []byte("name,udpPort\ngw-a,1\ngw-a,2\n"), 0600))
+			err = (&Lookup{File: table, Key: "name"}).load()
+			require.ErrorContains(t, err, "more than one row for name gw-a")
+		})
+	})
+
+	t.Run("http_lookup", func(t *testing.T) {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if auth := r.Header.Get("Authorization"); auth != "token" && auth != "lookup-file-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+		}))
+		defer srv.Close()
+
+		var pipeline Pipeline
+		require.NoError(t, yaml.Unmarshal(yamlify(fmt.Sprintf(`
+		processors:
+			- http_lookup:
+					url: %s/api/node/{{.uid}}/config/network
+					headers:
+						Authorization: token
+					into: network
+				`, srv.URL)), &pipeline))
+
+		for _, uid := range []string{"one", "two", "one"} {
+			ctx, cancel := WithReporter(t.Context(), "test")
+			output, err := pipeline.Process(ctx, map[string]any{"uid": uid})
+			cancel()
+			require.NoError(t, err)
+			res, ok := output.(map[string]any)
+			require.True(t, ok)
+			assert.Equal(t, map[string]any{"path": "/api/node/" + uid + "/config/network"}, res["network"])
+		}
+		assert.Equal(t, int32(2), requests.Load(), "responses should be cached by URL")
+
+		processor := HTTPLookup{URL: srv.URL, Into: "network"}
+		ctx, cancel := WithReporter(t.Context(), "test")
+		defer cancel()
+		_, err := processor.Process(ctx, map[string]any{"uid": "one"})
+		require.ErrorContains(t, err, "unexpected status code")
+
+		err = yaml.Unmarshal(yamlify(`
+		processors:
+			- http_lookup:
+					url: http://localhost/api/node/{{.uid}}
+				`), &pipeline)
+		require.ErrorContains(t, err, "http_lookup processor requires into")
+
+		token := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(token, []byte("lookup-file-token\n"), 0600))
+		t.Setenv("LOOKUP_PATH", "lookup-secret-path")
+		processor = HTTPLookup{
+			URL:     srv.URL + "/${env:LOOKUP_PATH}/{{.uid}}",
+			Headers: map[string]string{"Authorization": "${file:" + token + "}"},
+			Into:    "network",
+		}
+		output, err := processor.Process(ctx, map[string]any{"uid": "${env:LOOKUP_PATH}"})
+		require.NoError(t, err, "secrets in the url and headers are resolved")
+		assert.Equal(t, map[string]any{"path": "/lookup-secret-path/${env:LOOKUP_PATH}"}, output.(map[string]any)["network"], "messages aren't resolved")
+	})
+
 	t.Run("e2e", func(t *testing.T) {
 		t.Run("tg udp case", func(t *testing.T) {
 			pipeline := Pipeline{
@@ -3,28 +3,190 @@ package plan
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"net/http"
+	"reflect"
+	"slices"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Plan represents the entire configuration for a run of jsoninator.
 type Plan struct {
-	Input        Input    `yaml:"input"`
-	Pipeline     Pipeline `yaml:"pipeline"`
-	Output       Output   `yaml:"output"`
-	DryRun       bool     `yaml:"-"`
-	skipReporter bool     `yaml:"-"`
+	Input        Input         `yaml:"input"`
+	Pipeline     Pipeline      `yaml:"pipeline"`
+	Output       Output        `yaml:"output"`
+	Outputs      []NamedOutput `yaml:"outputs"` // used instead of Output to publish to several places
+	Rollout      Rollout       `yaml:"rollout"`
+	Rollback     *Rollback     `yaml:"rollback"`
+	Tests        []PlanTest    `yaml:"tests"` // run by RunTests rather than Run
+	HTTPClient   *HTTPClient   `yaml:"http_client"`
+	DryRun       bool          `yaml:"-"`
+	skipReporter bool          `yaml:"-"`
+
+	// dir is the report directory for the run.
+	dir string
+	// rawOutputHeaders, rawOutputAuth, rawOutputClient and rawHTTPClient are
+	// the output's headers, auth and clients before environment variables were
+	// expanded.
+	rawOutputHeaders map[string]string
+	rawOutputAuth    *Auth
+	rawOutputClient  *HTTPClient
+	rawHTTPClient    *HTTPClient
+	// previewer records the requests a dry run would have sent.
+	previewer *previewer
+	rollback  *rollbackRecorder
+
+	// ResumeDir is the report directory of an earlier run to resume. Messages
+	// it finished with are skipped, and reports are added to it.
+	ResumeDir string `yaml:"-"`
+
+	// Client sends the plan's HTTP requests, in place of any http_client
+	// configuration. If it's nil, clients are built from the configuration, or
+	// http.DefaultClient is used.
+	Client *http.Client `yaml:"-"`
+
+	// Transport, if set, wraps the transport of every client the plan sends
+	// requests with, including those built from the configuration, such as
+	// to record them.
+	Transport func(http.RoundTripper) http.RoundTripper `yaml:"-"`
+
+	// Confirm is asked whether to continue between rollout waves. If it's
+	// nil, every wave is published without pausing.
+	Confirm func(prompt string) bool `yaml:"-"`
 }
 
 // Parse parses a Plan from YAML data. Environment variables in the YAML
-// are expanded before parsing.
+// are expanded before parsing, except for ${file:/path} and ${env:NAME}
+// secret references, which are resolved when they're used. $$ is a literal $.
 func Parse(data []byte) (Plan, error) {
 	var plan Plan
-	expanded := os.ExpandEnv(string(data))
-	return plan, yaml.Unmarshal([]byte(expanded), &plan)
+	expanded := expandEnv(string(data))
+	if err := yaml.Unmarshal([]byte(expanded), &plan); err != nil {
+		return plan, err
+	}
+	if err := plan.checkOutputs(); err != nil {
+		return plan, err
+	}
+	addSecrets(plan.Input.HTTP.Headers, plan.Input.HTTP.Auth)
+	for _, out := range plan.outputs() {
+		addSecrets(out.HTTP.Headers, out.HTTP.Auth)
+	}
+	for _, proc := range plan.Pipeline.Processors {
+		if h, ok := proc.(HTTPLookup); ok {
+			addSecrets(h.Headers, nil)
+		}
+	}
+
+	var raw struct {
+		Output struct {
+			HTTP struct {
+				Headers map[string]string `yaml:"headers"`
+				Auth    *Auth             `yaml:"auth"`
+				Client  *HTTPClient       `yaml:"client"`
+			} `yaml:"http"`
+		} `yaml:"output"`
+		HTTPClient *HTTPClient `yaml:"http_client"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err == nil {
+		plan.rawOutputHeaders = raw.Output.HTTP.Headers
+		plan.rawOutputAuth = raw.Output.HTTP.Auth
+		plan.rawOutputClient = raw.Output.HTTP.Client
+		plan.rawHTTPClient = raw.HTTPClient
+	}
+	return plan, nil
+}
+
+// checkOutputs makes sure a plan's outputs can be told apart in the reports.
+func (p Plan) checkOutputs() error {
+	if len(p.Outputs) == 0 {
+		return nil
+	}
+	// Any output setting at all, not just an HTTP URL, would be silently
+	// ignored in favour of outputs.
+	if !reflect.ValueOf(p.Output).IsZero() {
+		return fmt.Errorf("output and outputs can't both be set")
+	}
+	seen := make(map[string]bool, len(p.Outputs))
+	for i, out := range p.Outputs {
+		if out.Name == "" {
+			return fmt.Errorf("outputs[%d] needs a name", i)
+		}
+		if seen[out.Name] {
+			return fmt.Errorf("outputs[%d]: %s is already used", i, out.Name)
+		}
+		seen[out.Name] = true
+	}
+	return nil
+}
+
+// outputs are where items are published. A plan with a single output has one
+// unnamed output.
+func (p Plan) outputs() []NamedOutput {
+	if len(p.Outputs) == 0 {
+		return []NamedOutput{{Output: p.Output}}
+	}
+	return p.Outputs
+}
+
+// retries is how many times a message that hits a conflict may be retried,
+// which is the most that any output allows.
+func (p Plan) retries() int {
+	retries := 0
+	for _, out := range p.outputs() {
+		retries = max(retries, out.retries())
+	}
+	return retries
+}
+
+// UsesStdout reports whether any of the plan's outputs write to stdout, in
+// which case progress messages should be written somewhere else.
+func (p Plan) UsesStdout() bool {
+	for _, out := range p.outputs() {
+		if out.Stdout {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHTTPOutput reports whether any of the plan's outputs publish over HTTP.
+func (p Plan) hasHTTPOutput() bool {
+	for _, out := range p.outputs() {
+		if out.HTTP.URL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// openOutputs opens each of the plan's outputs. The plan's outputs are copied
+// first, so the open files belong to this run alone.
+func (p *Plan) openOutputs() error {
+	p.Outputs = slices.Clone(p.Outputs)
+	if err := p.Output.Open(); err != nil {
+		return fmt.Errorf("opening output: %w", err)
+	}
+	for i := range p.Outputs {
+		if err := p.Outputs[i].Open(); err != nil {
+			return fmt.Errorf("opening output %s: %w", p.Outputs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// closeOutputs closes each of the plan's outputs.
+func (p Plan) closeOutputs() {
+	if err := p.Output.Close(); err != nil {
+		slog.Error("unable to close output", "err", err)
+	}
+	for _, out := range p.Outputs {
+		if err := out.Close(); err != nil {
+			slog.Error("unable to close output", "name", out.Name, "err", err)
+		}
+	}
 }
 
 func id(msg Message) string {
@@ -46,30 +208,257 @@ func id(msg Message) string {
 	return fmt.Sprintf("%v", msg)
 }
 
+// processMsg runs a message through the pipeline and publishes the result.
+// Once a message has started it's allowed to finish, even if the run is
+// interrupted. If publishing hits a conflict, the message is read from the
+// input again and retried, as many times as the output allows.
 func (p Plan) processMsg(ctx context.Context, msg Message) error {
-	ctx, cancel := WithReporter(ctx, id(msg))
-	defer cancel()
-	fmt.Println("Processing", id(msg))
-	processed, err := p.Pipeline.Process(ctx, msg)
+	for attempt := 0; ; attempt++ {
+		err := p.processOnce(ctx, msg, attempt < p.retries())
+		if !errors.Is(err, errConflict) || attempt >= p.retries() {
+			return err
+		}
+
+		slog.Warn("conflict publishing message, retrying", "name", id(msg), "attempt", attempt+1, "err", err)
+		if msg, err = p.reread(context.WithoutCancel(ctx), id(msg)); err != nil {
+			return fmt.Errorf("re-reading after conflict: %w", err)
+		}
+	}
+}
+
+// processOnce makes a single attempt at processing a message. If retry is set
+// and the attempt hits a conflict, its reporter is dropped so that only the
+// retry is reported.
+func (p Plan) processOnce(ctx context.Context, msg Message, retry bool) (err error) {
+	reporter := NewReporter(id(msg))
+	ctx = context.WithValue(context.WithoutCancel(ctx), reporterKey, reporter)
+	defer func() {
+		if retry && errors.Is(err, errConflict) {
+			reporter.discard()
+		}
+		reporter.Close()
+	}()
+
+	fmt.Fprintln(Progress, "Processing", id(msg))
+	items, err := p.Pipeline.ProcessAll(ctx, msg)
+	if err != nil {
+		reporter.Fail(err)
+		return err
+	}
+	if p.DryRun {
+		p.previewAll(ctx, items)
+		return nil
+	}
+
+	for _, item := range items {
+		if err = p.publish(ctx, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessages reads the input and splits it into messages.
+func (p Plan) readMessages(ctx context.Context) ([]Message, error) {
+	inputData, err := p.Input.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading input: %w", err)
+	}
+
+	var message Message
+	if err := json.Unmarshal(inputData, &message); err != nil {
+		slog.Error("unexpected input format", "input", truncate(string(inputData), maxErrorBody), "err", err)
+		return nil, fmt.Errorf("parsing input: %w: %s", err, truncate(string(inputData), maxErrorBody))
+	}
+
+	var msgs []Message
+	switch msg := message.(type) {
+	case []any:
+		for _, item := range msg {
+			msgs = append(msgs, item)
+		}
+	default:
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// reread reads the input again and returns the current version of the
+// message with the given name.
+func (p Plan) reread(ctx context.Context, name string) (Message, error) {
+	msgs, err := p.readMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if id(msg) == name {
+			return msg, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is no longer in the input", name)
+}
+
+// publish sends an item to each output it's routed to, recording the outcome
+// with the item's reporter. Every output is tried even if an earlier one
+// fails. Publishes aren't cancelled if the run is interrupted, so requests
+// that are in flight get to finish.
+func (p Plan) publish(ctx context.Context, item Item) error {
+	ctx = context.WithoutCancel(ctx)
+	reporter := item.reporter
+	if reporter == nil {
+		// Nothing is recorded for items without a reporter.
+		reporter = NewReporter(id(item.Original))
+	}
+	ctx = context.WithValue(ctx, reporterKey, reporter)
+
+	var errs []error
+	routed := false
+	for _, out := range p.outputs() {
+		if out.When != nil {
+			if reason := out.When.match(item.Message); reason != "" {
+				reporter.Routed(out.Name, outcomeFiltered, reason)
+				continue
+			}
+		}
+		routed = true
+
+		unchanged, err := p.publishTo(ctx, out.Output, item)
+		switch {
+		case unchanged:
+			reporter.Unchanged()
+			reporter.Routed(out.Name, outcomeUnchanged, "")
+		case errors.Is(err, errConflict):
+			reporter.Routed(out.Name, outcomeConflict, err.Error())
+		case err != nil:
+			reporter.Routed(out.Name, outcomeError, err.Error())
+		default:
+			reporter.Routed(out.Name, outcomePublished, "")
+		}
+		if err != nil && out.Name != "" {
+			err = fmt.Errorf("%s: %w", out.Name, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err := errors.Join(errs...)
 	switch {
+	case !routed:
+		reporter.Skip("no output matched")
+	case errors.Is(err, errConflict):
+		reporter.Conflict(err)
 	case err != nil:
+		reporter.Fail(err)
+	case !reporter.unchanged:
+		reporter.Publish()
+	}
+	return err
+}
+
+// publishTo sends an item to one output. It reports whether the item was
+// skipped because it wouldn't change the output's target.
+func (p Plan) publishTo(ctx context.Context, out Output, item Item) (bool, error) {
+	ctx, err := out.withClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	unchanged, err := out.unchanged(ctx, item)
+	if unchanged || err != nil {
+		return unchanged, err
+	}
+	// The captured state is added to the rollback plan as soon as the target
+	// is written, so it's there even if something after the write fails.
+	if p.rollback != nil {
+		captured, err := p.captureBefore(ctx, item)
+		if err != nil {
+			return false, err
+		}
+		if captured != nil {
+			out.written = func() {
+				p.rollback.entries = append(p.rollback.entries, *captured)
+			}
+		}
+	}
+	return false, out.PublishItem(ctx, item)
+}
+
+// runBatch is used when the pipeline has stages. Every message is run through
+// the pipeline up to its last stage together, and then each resulting message
+// finishes the pipeline and is published in turn.
+func (p Plan) runBatch(ctx context.Context, msgs []Message) error {
+	var b batch
+	defer b.close(ctx)
+
+	items, err := newItems(msgs)
+	if err != nil {
 		return err
-	case processed == nil:
-		return nil
-	case p.DryRun:
-		return nil
 	}
 
-	return p.Output.Publish(context.Background(), msg, processed)
+	last := p.Pipeline.lastStage()
+	items, err = b.processStream(ctx, p.Pipeline.Processors[:last+1], items)
+	if err != nil {
+		return fmt.Errorf("processing messages: %w", err)
+	}
+
+	// Each reporter is closed as soon as its last message is published, so the
+	// checkpoint is kept up to date as the run goes.
+	lastUse := b.lastUses(items)
+	for i, item := range items {
+		if ctx.Err() != nil {
+			return interrupted(ctx, items[i:])
+		}
+		processed, err := processEach(ctx, p.Pipeline.Processors[last+1:], []Item{item})
+		if err != nil {
+			if item.reporter != nil {
+				item.reporter.Fail(err)
+			}
+			return fmt.Errorf("processing message: %w", err)
+		}
+		if p.DryRun {
+			p.previewAll(ctx, processed)
+		} else {
+			for _, out := range processed {
+				if err := p.publish(ctx, out); err != nil {
+					return fmt.Errorf("processing message: %w", err)
+				}
+			}
+		}
+		if r := item.reporter; r != nil && lastUse[r] == i {
+			r.Close()
+		}
+	}
+
+	return nil
 }
 
 // Run executes the plan: it reads input, processes messages through the pipeline,
 // and publishes the output.
 func (p Plan) Run(ctx context.Context) error {
+	if p.Client != nil {
+		ctx = WithClient(ctx, p.Client)
+	}
+	if p.Transport != nil {
+		ctx = WithTransport(ctx, p.Transport)
+	}
+	ctx, err := withClientConfig(ctx, p.HTTPClient)
+	if err != nil {
+		return err
+	}
+	// A resumed dry run still skips the messages the resumed run finished,
+	// but its reports go to a new directory rather than being mixed in with
+	// the real run's.
+	if p.dir == "" && !p.DryRun {
+		p.dir = p.ResumeDir
+	}
+	if p.dir == "" {
+		p.dir = reportDir()
+	}
+
 	if !p.skipReporter {
 		done := make(chan struct{})
 		go func() {
-			report(ctx)
+			report(p.dir, reports, p.DryRun)
 			close(done)
 		}()
 
@@ -79,32 +468,99 @@ func (p Plan) Run(ctx context.Context) error {
 		}()
 	}
 
-	inputData, err := p.Input.Read(ctx)
+	if p.Rollback != nil && !p.DryRun {
+		if p.Output.HTTP.URL == "" {
+			return fmt.Errorf("rollback requires a single http output")
+		}
+		// The rollback plan sends captured states as they are, and there's no
+		// telling how a body template would have wrapped them.
+		if p.Output.HTTP.BodyTemplate != "" {
+			return fmt.Errorf("rollback can't be used with body_template")
+		}
+		p.rollback = &rollbackRecorder{}
+		defer func() {
+			if err := p.writeRollback(); err != nil {
+				slog.Error("unable to write rollback plan", "err", err)
+			}
+		}()
+	}
+
+	if err := p.checkStatusCodes(); err != nil {
+		return err
+	}
+
+	msgs, err := p.readMessages(ctx)
 	if err != nil {
-		return fmt.Errorf("reading input: %w", err)
+		return err
 	}
 
-	var original Message
-	var message Message
-	if err := json.Unmarshal(inputData, &message); err != nil {
-		slog.Error("unexpected input format", "input", string(inputData), "err", err)
-		return fmt.Errorf("parsing input: %w", err)
+	if p.DryRun && p.hasHTTPOutput() {
+		if p.previewer, err = newPreviewer(p.dir); err != nil {
+			return err
+		}
+		defer func() {
+			if err := p.previewer.close(); err != nil {
+				slog.Error("unable to write previewed requests", "err", err)
+			}
+		}()
+	}
+
+	err = p.openOutputs()
+	defer p.closeOutputs()
+	if err != nil {
+		return err
 	}
-	if err := json.Unmarshal(inputData, &original); err != nil {
-		slog.Error("unexpected input format", "input", string(inputData), "err", err)
-		return fmt.Errorf("parsing input: %w", err)
+
+	if p.ResumeDir != "" {
+		finished, err := readCheckpoint(p.ResumeDir)
+		if err != nil {
+			return fmt.Errorf("resuming: %w", err)
+		}
+		total := len(msgs)
+		msgs = slices.DeleteFunc(msgs, func(msg Message) bool {
+			return finished[id(msg)]
+		})
+		fmt.Fprintf(Progress, "Resuming %s: skipping %d of %d messages that already finished\n", p.ResumeDir, total-len(msgs), total)
 	}
 
-	switch msg := message.(type) {
-	case []any:
-		for _, item := range msg {
-			if err := p.processMsg(ctx, item); err != nil {
-				return fmt.Errorf("processing message: %w", err)
+	switch {
+	case len(p.Rollout.Waves) > 0:
+		return p.runRollout(ctx, msgs)
+	case p.Pipeline.lastStage() >= 0:
+		return p.runBatch(ctx, msgs)
+	}
+
+	for i, msg := range msgs {
+		if ctx.Err() != nil {
+			notRun := make([]Item, 0, len(msgs)-i)
+			for _, msg := range msgs[i:] {
+				notRun = append(notRun, Item{Original: msg})
 			}
+			return interrupted(ctx, notRun)
 		}
-		return nil
-	default:
-		err := p.processMsg(ctx, msg)
-		return err
+		if err := p.processMsg(ctx, msg); err != nil {
+			return fmt.Errorf("processing message: %w", err)
+		}
+	}
+	return nil
+}
+
+// interrupted prints a summary of the messages an interrupted run didn't get
+// to, and drops their reporters so they're left out of the reports.
+func interrupted(ctx context.Context, notRun []Item) error {
+	var names []string
+	for _, item := range notRun {
+		if item.reporter != nil {
+			item.reporter.discard()
+		}
+		if name := id(item.Original); !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	fmt.Fprintf(Progress, "Interrupted: %d messages were not run\n", len(names))
+	for _, name := range names {
+		fmt.Fprintln(Progress, "  ", name)
 	}
+	return fmt.Errorf("interrupted: %w", context.Cause(ctx))
 }
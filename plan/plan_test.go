@@ -2,10 +2,21 @@ package plan
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "embed"
 
@@ -35,10 +46,12 @@ pipeline:
 
 func Test_Plan(t *testing.T) {
 	go func() {
-		select {
-		case <-reports:
-		case <-t.Context().Done():
-			return
+		for {
+			select {
+			case <-reports:
+			case <-t.Context().Done():
+				return
+			}
 		}
 	}()
 
@@ -84,6 +97,1063 @@ input:
 		}, plan.Input.HTTP.Headers)
 	})
 
+	t.Run("group_by", func(t *testing.T) {
+		plan, err := Parse([]byte(`
+input:
+  raw: |
+    [{"uid": "a", "cluster": "east"}, {"uid": "b", "cluster": "west"}, {"uid": "c", "cluster": "east"}]
+
+pipeline:
+  processors:
+    - group_by:
+        key: "{{.cluster}}"
+        fields:
+          uids:
+            op: collect
+            field: uid
+    - transform:
+        fields:
+          size: 1
+`))
+		require.NoError(t, err)
+		plan.skipReporter = true
+		buf := bytes.NewBuffer(nil)
+		plan.Output.Buffer = buf
+		require.NoError(t, plan.Run(t.Context()))
+		assert.JSONEq(t, `{"key":"east","uids":["a","c"],"size":1}`, strings.Split(buf.String(), "\n")[0])
+		assert.JSONEq(t, `{"key":"west","uids":["b"],"size":1}`, strings.Split(buf.String(), "\n")[1])
+	})
+
+	t.Run("rollout", func(t *testing.T) {
+		t.Run("wave sizes", func(t *testing.T) {
+			sizes, err := Rollout{Waves: []string{"1", "10%", "50%"}}.sizes(20)
+			require.NoError(t, err)
+			assert.Equal(t, []int{1, 2, 10, 7}, sizes)
+
+			sizes, err = Rollout{Waves: []string{"5", "100%"}}.sizes(3)
+			require.NoError(t, err)
+			assert.Equal(t, []int{3}, sizes)
+
+			_, err = Rollout{Waves: []string{"ten"}}.sizes(3)
+			require.Error(t, err)
+		})
+
+		rolloutPlan := func(t *testing.T, url string) Plan {
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: |
+    [{"uid": "1"}, {"uid": "2"}, {"uid": "3"}, {"uid": "4"}, {"uid": "5"}]
+
+rollout:
+  waves: [1, 2]
+  max_error_percent: 50
+
+output:
+  http:
+    url: %s/{{.uid}}
+    method: PUT
+    status_codes: [200]
+`, url)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			return plan
+		}
+
+		t.Run("pauses between waves", func(t *testing.T) {
+			var published []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				published = append(published, r.URL.Path)
+			}))
+			defer srv.Close()
+
+			plan := rolloutPlan(t, srv.URL)
+			var prompts []string
+			plan.Confirm = func(prompt string) bool {
+				prompts = append(prompts, prompt)
+				return len(prompts) < 2
+			}
+			require.NoError(t, plan.Run(t.Context()))
+			assert.Equal(t, []string{"/1", "/2", "/3"}, published)
+			assert.Equal(t, []string{
+				"Continue with wave 2 of 3 (2 messages)?",
+				"Continue with wave 3 of 3 (2 messages)?",
+			}, prompts)
+		})
+
+		t.Run("stops when a wave fails too often", func(t *testing.T) {
+			var published []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				published = append(published, r.URL.Path)
+				if r.URL.Path != "/1" {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer srv.Close()
+
+			err := rolloutPlan(t, srv.URL).Run(t.Context())
+			require.ErrorContains(t, err, "rollout stopped after wave 2: 2 of 2 publishes failed")
+			assert.Equal(t, []string{"/1", "/2", "/3"}, published)
+		})
+
+		t.Run("resumes after a declined wave", func(t *testing.T) {
+			var r Reporter
+			r.stop("rollout stopped before wave 3")
+			assert.Equal(t, "not run", r.outcome())
+
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, checkpointFile), []byte(
+				"name,outcome\n1,published\n2,published\n3,published\n4,not run\n5,not run\n",
+			), 0600))
+
+			var published []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				published = append(published, r.URL.Path)
+			}))
+			defer srv.Close()
+
+			plan := rolloutPlan(t, srv.URL)
+			plan.ResumeDir = dir
+			require.NoError(t, plan.Run(t.Context()))
+			assert.Equal(t, []string{"/4", "/5"}, published)
+		})
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, checkpointFile), []byte(
+			"name,outcome\n1,published\n2,filtered\n3,error\n4,published\n4,error\n",
+		), 0600))
+
+		plan, err := Parse([]byte(`
+input:
+  raw: |
+    [{"uid": "1"}, {"uid": "2"}, {"uid": "3"}, {"uid": "4"}, {"uid": "5"}]
+`))
+		require.NoError(t, err)
+		plan.skipReporter = true
+		plan.ResumeDir = dir
+		buf := bytes.NewBuffer(nil)
+		plan.Output.Buffer = buf
+		require.NoError(t, plan.Run(t.Context()))
+		assert.Equal(t, "{\"uid\":\"3\"}\n{\"uid\":\"4\"}\n{\"uid\":\"5\"}\n", buf.String())
+
+		plan.ResumeDir = filepath.Join(dir, "missing")
+		require.ErrorContains(t, plan.Run(t.Context()), "resuming")
+
+		t.Chdir(t.TempDir())
+		plan.ResumeDir = dir
+		plan.DryRun = true
+		plan.Output.HTTP.URL = "http://localhost/{{.uid}}"
+		require.NoError(t, plan.Run(t.Context()))
+		assert.NoFileExists(t, filepath.Join(dir, requestsFile), "dry runs don't add to the resumed run's reports")
+		previewed, err := filepath.Glob(filepath.Join("reports", "*", requestsFile))
+		require.NoError(t, err)
+		require.Len(t, previewed, 1)
+		data, err := os.ReadFile(previewed[0])
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), `"name":"1"`, "finished messages are still skipped")
+		assert.Contains(t, string(data), `"name":"5"`)
+	})
+
+	t.Run("interrupted runs finish in-flight publishes", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		var published []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cancel()
+			published = append(published, r.URL.Path)
+		}))
+		defer srv.Close()
+
+		plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: |
+    [{"uid": "1"}, {"uid": "2"}, {"uid": "3"}]
+
+output:
+  http:
+    url: %s/{{.uid}}
+    method: PUT
+    status_codes: [200]
+`, srv.URL)))
+		require.NoError(t, err)
+		plan.skipReporter = true
+		require.ErrorIs(t, plan.Run(ctx), context.Canceled)
+		assert.Equal(t, []string{"/1"}, published)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		for _, capture := range []string{"original", "fetch"} {
+			t.Run(capture, func(t *testing.T) {
+				state := map[string]string{
+					"/node/1/config/gateway": `{"enabled":true,"udpEnabled":false,"hash":"$2b$10$abc","$ref":"#/x"}`,
+					"/node/2/config/gateway": `{"enabled":false}`,
+				}
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, "secret", r.Header.Get("Authorization"))
+					if r.Method == http.MethodGet {
+						fmt.Fprint(w, state[r.URL.Path])
+						return
+					}
+					body, err := io.ReadAll(r.Body)
+					require.NoError(t, err)
+					state[r.URL.Path] = strings.TrimSpace(string(body))
+				}))
+				defer srv.Close()
+
+				t.Setenv("ROLLBACK_TOKEN", "secret")
+				t.Setenv("ROLLBACK_TIMEOUT", "30s")
+				plan, err := Parse([]byte(fmt.Sprintf(`
+http_client:
+  timeout: ${ROLLBACK_TIMEOUT}
+
+input:
+  raw: |
+    [{"uid": "1", "config": {"gateway": {"enabled": true, "udpEnabled": false, "hash": "$$2b$$10$$abc", "$$ref": "#/x"}}},
+     {"uid": "2", "config": {"gateway": {"enabled": false}}}]
+
+pipeline:
+  processors:
+    - map:
+        field: config.gateway
+    - transform:
+        fields:
+          udpEnabled: true
+
+rollback:
+  capture: %s
+
+output:
+  http:
+    url: %s/node/{{.uid}}/config/gateway
+    method: PUT
+    status_codes: [200]
+    headers:
+      Authorization: ${ROLLBACK_TOKEN}
+    client:
+      insecure_skip_verify: true
+`, capture, srv.URL)))
+				require.NoError(t, err)
+				plan.skipReporter = true
+				plan.dir = t.TempDir()
+				require.NoError(t, plan.Run(t.Context()))
+				require.NoError(t, plan.Run(t.Context()), "a resumed run adds to the same rollback plan")
+				assert.JSONEq(t, `{"enabled":true,"udpEnabled":true,"hash":"$2b$10$abc","$ref":"#/x"}`, state["/node/1/config/gateway"])
+				assert.JSONEq(t, `{"enabled":false,"udpEnabled":true}`, state["/node/2/config/gateway"])
+
+				data, err := os.ReadFile(filepath.Join(plan.dir, rollbackFile))
+				require.NoError(t, err)
+				assert.Contains(t, string(data), "# Rolls back the 2 messages published")
+				assert.Contains(t, string(data), "Authorization: ${ROLLBACK_TOKEN}")
+				assert.NotContains(t, string(data), "secret")
+
+				rollback, err := Parse(data)
+				require.NoError(t, err)
+				require.NotNil(t, rollback.HTTPClient, "http clients are carried over")
+				assert.Equal(t, "30s", rollback.HTTPClient.Timeout)
+				require.NotNil(t, rollback.Output.HTTP.Client)
+				assert.True(t, rollback.Output.HTTP.Client.InsecureSkipVerify)
+				assert.Contains(t, string(data), "timeout: ${ROLLBACK_TIMEOUT}")
+
+				rollback, err = Parse(data)
+				require.NoError(t, err)
+				rollback.skipReporter = true
+				rollback.dir = t.TempDir()
+				require.NoError(t, rollback.Run(t.Context()))
+				assert.JSONEq(t, `{"enabled":true,"udpEnabled":false,"hash":"$2b$10$abc","$ref":"#/x"}`, state["/node/1/config/gateway"],
+					"dollar signs in captured states aren't expanded")
+				assert.JSONEq(t, `{"enabled":false}`, state["/node/2/config/gateway"])
+			})
+		}
+
+		t.Run("only successful publishes are rolled back", func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/node/2" {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer srv.Close()
+
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: '[{"uid": "1"}, {"uid": "2"}]'
+rollback: {}
+output:
+  http:
+    url: %s/node/{{.uid}}
+    method: PUT
+    status_codes: [200]
+`, srv.URL)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			plan.dir = t.TempDir()
+			require.ErrorContains(t, plan.Run(t.Context()), "unexpected status code")
+
+			data, err := os.ReadFile(filepath.Join(plan.dir, rollbackFile))
+			require.NoError(t, err)
+			assert.Contains(t, string(data), "# Rolls back the 1 messages published")
+			assert.Contains(t, string(data), srv.URL+"/node/1")
+			assert.NotContains(t, string(data), srv.URL+"/node/2")
+		})
+
+		t.Run("writes are rolled back even if something after them fails", func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer srv.Close()
+
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: '[{"uid": "1"}]'
+rollback: {}
+output:
+  http:
+    url: %s/node/{{.uid}}
+    method: PUT
+    status_codes: [200]
+    verify: {}
+  exec:
+    command: "false"
+`, srv.URL)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			plan.dir = t.TempDir()
+			require.ErrorContains(t, plan.Run(t.Context()), "exit status 1")
+
+			data, err := os.ReadFile(filepath.Join(plan.dir, rollbackFile))
+			require.NoError(t, err)
+			assert.Contains(t, string(data), srv.URL+"/node/1")
+
+			plan.Output.Exec = Exec{}
+			item, err := newItem(map[string]any{"uid": "1"})
+			require.NoError(t, err)
+			require.NoError(t, plan.publish(t.Context(), item), "a failed verify doesn't fail the publish")
+			assert.Equal(t, "unverified", item.reporter.outcome())
+			assert.Contains(t, item.reporter.unverified, "500")
+		})
+
+		t.Run("patches are rolled back with full puts", func(t *testing.T) {
+			var sent []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				sent = append(sent, r.Method+" "+r.Header.Get("Content-Type")+" "+strings.TrimSpace(string(body)))
+			}))
+			defer srv.Close()
+
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: '[{"uid": "1", "added": null}]'
+pipeline:
+  processors:
+    - transform:
+        fields:
+          added: true
+rollback: {}
+output:
+  http:
+    url: %s/node/{{.uid}}
+    method: PATCH
+    body: merge-patch
+    status_codes: [200]
+    headers:
+      Content-Type: application/merge-patch+json
+`, srv.URL)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			plan.dir = t.TempDir()
+			require.NoError(t, plan.Run(t.Context()))
+
+			data, err := os.ReadFile(filepath.Join(plan.dir, rollbackFile))
+			require.NoError(t, err)
+			rollback, err := Parse(data)
+			require.NoError(t, err)
+			rollback.skipReporter = true
+			rollback.dir = t.TempDir()
+			require.NoError(t, rollback.Run(t.Context()))
+			assert.Equal(t, []string{
+				`PATCH application/merge-patch+json {"added":true}`,
+				`PUT application/json {"added":null,"uid":"1"}`,
+			}, sent)
+		})
+
+		t.Run("refused with body templates", func(t *testing.T) {
+			plan, err := Parse([]byte(`
+input:
+  raw: '[{"uid": "1"}]'
+rollback: {}
+output:
+  http:
+    url: http://localhost/node/{{.uid}}
+    method: PUT
+    body_template: '{"config": {{json .processed}}}'
+`))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			plan.dir = t.TempDir()
+			require.ErrorContains(t, plan.Run(t.Context()), "rollback can't be used with body_template")
+		})
+
+		t.Run("not captured in dry runs", func(t *testing.T) {
+			plan, err := Parse([]byte(`
+input:
+  raw: '{"uid": "1"}'
+rollback: {}
+output:
+  http:
+    url: http://localhost/{{.uid}}
+    method: PUT
+`))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			plan.DryRun = true
+			plan.dir = t.TempDir()
+			require.NoError(t, plan.Run(t.Context()))
+			assert.NoFileExists(t, filepath.Join(plan.dir, rollbackFile))
+		})
+	})
+
+	t.Run("if_match", func(t *testing.T) {
+		// The node's version is bumped by someone else just before the first
+		// publish, so it conflicts until the input is read again.
+		version := 1
+		var ifMatches []string
+		var published map[string]any
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/nodes":
+				fmt.Fprintf(w, `[{"uid": "1", "version": %d}]`, version)
+			case r.Method == http.MethodGet:
+				w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, version))
+				fmt.Fprintf(w, `{"version": %d}`, version)
+			default:
+				ifMatches = append(ifMatches, r.Header.Get("If-Match"))
+				if len(ifMatches) == 1 {
+					version++
+				}
+				if r.Header.Get("If-Match") != fmt.Sprint(version) && r.Header.Get("If-Match") != fmt.Sprintf(`"v%d"`, version) {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&published))
+			}
+		}))
+		defer srv.Close()
+
+		ifMatchPlan := func(t *testing.T, ifMatch string) Plan {
+			version = 1
+			ifMatches = nil
+			published = nil
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  http:
+    url: %[1]s/nodes
+
+pipeline:
+  processors:
+    - transform:
+        fields:
+          udpEnabled: true
+
+output:
+  http:
+    url: %[1]s/node/{{.uid}}
+    method: PUT
+    status_codes: [200]
+    if_match:
+      %[2]s
+`, srv.URL, ifMatch)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			return plan
+		}
+
+		t.Run("conflicts without retries", func(t *testing.T) {
+			err := ifMatchPlan(t, "field: version").Run(t.Context())
+			require.ErrorIs(t, err, errConflict)
+			assert.Equal(t, []string{"1"}, ifMatches)
+		})
+
+		t.Run("retries from the input", func(t *testing.T) {
+			require.NoError(t, ifMatchPlan(t, "{field: version, retries: 1}").Run(t.Context()))
+			assert.Equal(t, []string{"1", "2"}, ifMatches)
+			assert.Equal(t, float64(2), published["version"])
+		})
+
+		t.Run("reads the etag", func(t *testing.T) {
+			require.NoError(t, ifMatchPlan(t, "{read: true, retries: 2}").Run(t.Context()))
+			assert.Equal(t, []string{`"v1"`, `"v2"`}, ifMatches)
+		})
+
+		t.Run("reads a field", func(t *testing.T) {
+			require.NoError(t, ifMatchPlan(t, "{read: true, field: version, retries: 2}").Run(t.Context()))
+			assert.Equal(t, []string{"1", "2"}, ifMatches)
+		})
+	})
+
+	t.Run("outputs", func(t *testing.T) {
+		published := make(map[string][]string)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			published[strings.Split(r.URL.Path, "/")[1]] = append(published[strings.Split(r.URL.Path, "/")[1]], r.URL.Path)
+			if r.URL.Path == "/audit/3" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer srv.Close()
+
+		plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  raw: |
+    [{"uid": "1", "type": "Gateway"}, {"uid": "2", "type": "Agent"}]
+
+outputs:
+  - name: gateways
+    when:
+      prefix:
+        type: Gateway
+    http:
+      url: %[1]s/gateways/{{.uid}}
+      method: PUT
+  - name: agents
+    when:
+      query: '{{eq .type "Agent"}}'
+    http:
+      url: %[1]s/agents/{{.uid}}
+      method: PUT
+  - name: audit
+    http:
+      url: %[1]s/audit/{{.uid}}
+      method: POST
+      status_codes: [200]
+`, srv.URL)))
+		require.NoError(t, err)
+		plan.skipReporter = true
+
+		require.NoError(t, plan.Run(t.Context()))
+		assert.Equal(t, map[string][]string{
+			"gateways": {"/gateways/1"},
+			"agents":   {"/agents/2"},
+			"audit":    {"/audit/1", "/audit/2"},
+		}, published)
+
+		item, err := newItem(map[string]any{"uid": "3", "type": "Other"})
+		require.NoError(t, err)
+		err = plan.publish(t.Context(), item)
+		require.ErrorContains(t, err, "audit: unexpected status code: 500")
+		assert.Equal(t, []routing{
+			{output: "gateways", outcome: "filtered", detail: `field "type" does not have prefix "Gateway"`},
+			{output: "agents", outcome: "filtered", detail: `query "{{eq .type \"Agent\"}}" evaluated to "false"`},
+			{output: "audit", outcome: "error", detail: "unexpected status code: 500"},
+		}, item.reporter.routings)
+		assert.Equal(t, "error", item.reporter.outcome())
+
+		plan.Outputs = plan.Outputs[:2]
+		item, err = newItem(map[string]any{"uid": "3", "type": "Other"})
+		require.NoError(t, err)
+		require.NoError(t, plan.publish(t.Context(), item))
+		assert.Equal(t, "filtered", item.reporter.outcome(), "messages no output wants are filtered")
+
+		_, err = Parse([]byte("outputs: [{name: a}, {name: a}]"))
+		require.ErrorContains(t, err, "a is already used")
+		_, err = Parse([]byte("outputs: [{http: {url: http://localhost}}]"))
+		require.ErrorContains(t, err, "outputs[0] needs a name")
+		for _, output := range []string{"{http: {url: http://localhost}}", "{file: {path: out.json}}", "{stdout: true}", "{exec: {command: cat}}"} {
+			_, err = Parse([]byte("output: " + output + "\noutputs: [{name: a}]"))
+			require.ErrorContains(t, err, "can't both be set", output)
+		}
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		dir := t.TempDir()
+		plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  exec:
+    command: sh
+    args: ["-c", "echo '[{\"uid\": \"1\"}, {\"uid\": \"2\"}]'"]
+
+pipeline:
+  processors:
+    - transform:
+        fields:
+          enabled: true
+
+output:
+  exec:
+    command: sh
+    args: ["-c", "cat > %s/{{.original.uid}}.json"]
+`, dir)))
+		require.NoError(t, err)
+		plan.skipReporter = true
+		require.NoError(t, plan.Run(t.Context()))
+
+		data, err := os.ReadFile(filepath.Join(dir, "2.json"))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"uid": "2", "enabled": true}`, string(data))
+
+		plan.Output.Exec.Args = []string{"-c", "echo no thanks >&2; exit 3"}
+		require.ErrorContains(t, plan.Run(t.Context()), "running sh: exit status 3: no thanks")
+
+		plan.Input.Exec.Args = []string{"-c", "exit 1"}
+		require.ErrorContains(t, plan.Run(t.Context()), "reading input: running sh: exit status 1")
+	})
+
+	t.Run("dry runs preview requests", func(t *testing.T) {
+		t.Setenv("PREVIEW_TOKEN", "secret")
+		plan, err := Parse([]byte(`
+input:
+  raw: '[{"uid": "1", "version": 3}, {"uid": "it''s"}]'
+
+output:
+  http:
+    url: http://localhost/node/{{.uid}}
+    method: PATCH
+    status_codes: [200, 204]
+    body: merge-patch
+    headers:
+      Authorization: Bearer ${PREVIEW_TOKEN}
+      X-Api-Key: ${PREVIEW_TOKEN}
+      X-Request: "{{.original.uid}}"
+    if_match:
+      field: version
+`))
+		require.NoError(t, err)
+		plan.Pipeline.Processors = []Processor{Transform{Fields: map[string]string{"enabled": "true"}}}
+		plan.skipReporter = true
+		plan.DryRun = true
+		plan.dir = t.TempDir()
+		require.NoError(t, plan.Run(t.Context()))
+
+		data, err := os.ReadFile(filepath.Join(plan.dir, requestsFile))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "secret")
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 1, "the message without a version can't be previewed")
+		assert.JSONEq(t, `{
+			"name": "1",
+			"method": "PATCH",
+			"url": "http://localhost/node/1",
+			"headers": {
+				"Authorization": "REDACTED",
+				"X-Api-Key": "REDACTED",
+				"X-Request": "1",
+				"Content-Type": "application/merge-patch+json",
+				"If-Match": "3"
+			},
+			"body": {"enabled": true},
+			"status_codes": [200, 204]
+		}`, lines[0])
+
+		data, err = os.ReadFile(filepath.Join(plan.dir, curlFile))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "curl -X PATCH 'http://localhost/node/1' \\\n  -H 'Authorization: REDACTED'")
+		assert.Contains(t, string(data), "<<'JSONINATOR_BODY'\n{\"enabled\":true}\nJSONINATOR_BODY\n")
+		assert.NotContains(t, string(data), "secret")
+
+		plan.Output.HTTP.StatusCodes = []int{2000}
+		require.ErrorContains(t, plan.Run(t.Context()), "invalid status code 2000")
+	})
+
+	t.Run("record and replay", func(t *testing.T) {
+		t.Setenv("RECORD_KEY", "record-key-value")
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/token":
+				fmt.Fprint(w, `{"access_token": "live-token-value", "expires_in": 3600}`)
+			case r.Method == http.MethodGet:
+				w.Header().Set("Set-Cookie", "session=live-session-value")
+				fmt.Fprint(w, `[{"uid": "1"}, {"uid": "2"}]`)
+			}
+		}))
+
+		recordPlan := func(t *testing.T, value string) Plan {
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  http:
+    url: %[1]s/nodes?key=${env:RECORD_KEY}
+    headers:
+      Authorization: secret
+
+pipeline:
+  processors:
+    - transform:
+        fields:
+          enabled: %[2]s
+
+output:
+  http:
+    url: %[1]s/node/{{.uid}}
+    method: PUT
+    status_codes: [200]
+    auth:
+      oauth2:
+        token_url: %[1]s/token
+        client_id: jsoninator
+        client_secret: client-secret-value
+`, srv.URL, value)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			return plan
+		}
+
+		dir := t.TempDir()
+		recorder, err := NewRecorder(dir, nil)
+		require.NoError(t, err)
+		plan := recordPlan(t, "true")
+		plan.Client = &http.Client{Transport: recorder}
+		require.NoError(t, plan.Run(t.Context()))
+		require.NoError(t, recorder.Close())
+		srv.Close()
+
+		data, err := os.ReadFile(filepath.Join(dir, exchangesFile))
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 4)
+		assert.NotContains(t, string(data), "secret")
+		assert.NotContains(t, string(data), "record-key-value", "secrets in URLs aren't recorded")
+		assert.NotContains(t, string(data), "live-token-value", "tokens aren't recorded")
+		assert.NotContains(t, string(data), "live-session-value", "cookies that are set aren't recorded")
+		assert.Equal(t, "Bearer REDACTED", Redact("Bearer live-token-value"), "tokens are redacted everywhere")
+
+		replayer, err := NewReplayer(dir)
+		require.NoError(t, err)
+		plan.Client = &http.Client{Transport: replayer}
+		require.NoError(t, plan.Run(t.Context()), "the recording is replayed without the server")
+
+		replayer, err = NewReplayer(dir)
+		require.NoError(t, err)
+		plan = recordPlan(t, "false")
+		plan.Client = &http.Client{Transport: replayer}
+		require.ErrorContains(t, plan.Run(t.Context()), "doesn't match the recording")
+
+		require.ErrorContains(t, plan.Run(t.Context()), "no recorded response for GET")
+	})
+
+	t.Run("plan tests", func(t *testing.T) {
+		plan, err := Parse([]byte(`
+pipeline:
+  processors:
+    - filter:
+        prefix:
+          type: Node
+    - map:
+        field: config.gateway
+    - transform:
+        fields:
+          udpEnabled: true
+          udpPort: "{{.port}}"
+
+tests:
+  - name: enables udp
+    input: {"uid": "1", "type": "Node", "config": {"gateway": {"port": 8995}}}
+    expect: {"port": 8995, "udpEnabled": true, "udpPort": 8995}
+  - name: skips agents
+    input: {"uid": "2", "type": "Agent"}
+    filtered: prefix
+  - name: wrong
+    input: [{"uid": "3", "type": "Node", "config": {"gateway": {"port": 1, "nested": {"a": 1}}}}]
+    expect: {"port": 2, "udpEnabled": true, "nested": {"a": 2}, "extra": "x"}
+  - input: {"uid": "4", "type": "Node", "config": {"gateway": {}}}
+    filtered: prefix
+`))
+		require.NoError(t, err)
+
+		t.Setenv("TEST_UID", "5")
+		more, err := ParseTests([]byte(`
+tests:
+  - name: from a sibling file
+    input: {"uid": "${TEST_UID}", "type": "Agent"}
+    expect: {"uid": "${TEST_UID}"}
+  - name: costs $$5
+    input: {"token": "${env:TEST_TOKEN}"}
+`))
+		require.NoError(t, err)
+		require.Len(t, more, 2)
+		assert.Equal(t, "costs $5", more[1].Name)
+		assert.Equal(t, map[string]any{"token": "${env:TEST_TOKEN}"}, more[1].Input, "secret references are left alone")
+		more = more[:1]
+		plan.Tests = append(plan.Tests, more...)
+
+		var out bytes.Buffer
+		assert.Equal(t, 3, plan.RunTests(t.Context(), &out))
+		assert.Equal(t, `PASS enables udp
+PASS skips agents
+FAIL wrong
+     extra: expected "x", but it's missing
+     nested.a: expected 2, got 1
+     port: expected 2, got 1
+     udpPort: unexpected 1
+FAIL test 4
+     4: expected to be filtered, but it wasn't
+FAIL from a sibling file
+     expected 1 messages, got 0
+     5 was filtered: field "type" does not have prefix "Node"
+2 of 5 tests passed
+`, out.String())
+	})
+
+	t.Run("http_client", func(t *testing.T) {
+		// The slow handler is still running after its client times out, so
+		// published is locked.
+		var (
+			mu        sync.Mutex
+			published []string
+		)
+		paths := func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Clone(published)
+		}
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `[{"uid": "1"}]`)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			published = append(published, r.URL.Path)
+		}))
+		defer srv.Close()
+
+		caCert := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: srv.Certificate().Raw,
+		}), 0600))
+
+		clientPlan := func(t *testing.T, config string) Plan {
+			mu.Lock()
+			published = nil
+			mu.Unlock()
+			plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  http:
+    url: %[1]s/nodes
+
+output:
+  http:
+    url: %[1]s/node/{{.uid}}
+    method: PUT
+    status_codes: [200]
+%[2]s
+`, srv.URL, config)))
+			require.NoError(t, err)
+			plan.skipReporter = true
+			return plan
+		}
+
+		require.ErrorContains(t, clientPlan(t, "").Run(t.Context()), "certificate")
+
+		require.NoError(t, clientPlan(t, "http_client: {insecure_skip_verify: true}").Run(t.Context()))
+		assert.Equal(t, []string{"/node/1"}, paths())
+
+		require.NoError(t, clientPlan(t, fmt.Sprintf("http_client: {ca_cert: %s}", caCert)).Run(t.Context()))
+		assert.Equal(t, []string{"/node/1"}, paths())
+
+		plan := clientPlan(t, "http_client: {insecure_skip_verify: true, timeout: 50ms}")
+		plan.Output.HTTP.URL = srv.URL + "/slow"
+		require.ErrorContains(t, plan.Run(t.Context()), "Client.Timeout exceeded")
+
+		plan = clientPlan(t, "")
+		plan.Input.HTTP.Client = &HTTPClient{CACert: caCert}
+		plan.Output.HTTP.Client = &HTTPClient{InsecureSkipVerify: true}
+		require.NoError(t, plan.Run(t.Context()), "inputs and outputs can have their own clients")
+		assert.Equal(t, []string{"/node/1"}, paths())
+
+		plan = clientPlan(t, "http_client: {insecure_skip_verify: true}")
+		plan.Output.HTTP.Client = &HTTPClient{}
+		require.ErrorContains(t, plan.Run(t.Context()), "certificate", "an output's client replaces the plan's")
+
+		plan = clientPlan(t, "")
+		plan.Client = srv.Client()
+		plan.Output.HTTP.Client = &HTTPClient{}
+		require.NoError(t, plan.Run(t.Context()), "a client from the API is used for everything")
+
+		dir := t.TempDir()
+		recorder, err := NewRecorder(dir, nil)
+		require.NoError(t, err)
+		plan = clientPlan(t, fmt.Sprintf("http_client: {ca_cert: %s}", caCert))
+		plan.Output.HTTP.Client = &HTTPClient{InsecureSkipVerify: true}
+		plan.Transport = recorder.Wrap
+		require.NoError(t, plan.Run(t.Context()), "recordings are made with the configured clients")
+		require.NoError(t, recorder.Close())
+		data, err := os.ReadFile(filepath.Join(dir, exchangesFile))
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 2)
+
+		require.ErrorContains(t, clientPlan(t, "http_client: {client_cert: cert.pem}").Run(t.Context()),
+			"client_cert and client_key must be set together")
+		require.ErrorContains(t, clientPlan(t, "http_client: {timeout: soon}").Run(t.Context()), "parsing timeout")
+	})
+
+	t.Run("input requests", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/search":
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, `{"type": "Node", "tags": ["a"]}`, string(body))
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `[{"uid": "1"}]`)
+			case "/login":
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "<html>%s</html>", strings.Repeat("x", 1000))
+			case "/text":
+				fmt.Fprint(w, "not json")
+			}
+		}))
+		defer srv.Close()
+
+		input, err := Parse([]byte(fmt.Sprintf(`
+input:
+  http:
+    url: %s/search
+    method: POST
+    body:
+      type: Node
+      tags: [a]
+`, srv.URL)))
+		require.NoError(t, err)
+		data, err := input.Input.Read(t.Context())
+		require.NoError(t, err, "any 2xx is accepted by default")
+		assert.JSONEq(t, `[{"uid": "1"}]`, string(data))
+
+		input.Input.HTTP.StatusCodes = []int{200}
+		_, err = input.Input.Read(t.Context())
+		require.ErrorContains(t, err, "unexpected status code 201 from POST "+srv.URL+"/search: [{\"uid\": \"1\"}]")
+
+		input.Input.HTTP.Method = ""
+		input.Input.HTTP.Body = nil
+		input.Input.HTTP.StatusCodes = nil
+		input.Input.HTTP.URL = srv.URL + "/login"
+		_, err = input.Input.Read(t.Context())
+		require.ErrorContains(t, err, "unexpected status code 401 from GET "+srv.URL+"/login: <html>xxx")
+		require.ErrorContains(t, err, "... (501 more bytes)")
+
+		input.Input.HTTP.URL = srv.URL + "/text"
+		input.skipReporter = true
+		require.ErrorContains(t, input.Run(t.Context()), "parsing input: invalid character 'o' in literal null (expecting 'u'): not json")
+	})
+
+	t.Run("secrets", func(t *testing.T) {
+		secretFile := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(secretFile, []byte("file-secret-value\n"), 0600))
+		t.Setenv("SECRET_ENV", "env-secret-value")
+		t.Setenv("INPUT_PATH", "nodes")
+		t.Setenv("LOOKUP_TOKEN", "expanded-lookup-token")
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/nodes", r.URL.Path)
+			assert.Equal(t, "file-secret-value", r.Header.Get("X-Token"))
+			assert.Equal(t, "Bearer env-secret-value", r.Header.Get("Authorization"))
+			fmt.Fprint(w, `[{"uid": "1"}]`)
+		}))
+		defer srv.Close()
+
+		plan, err := Parse([]byte(fmt.Sprintf(`
+input:
+  http:
+    url: %s/${INPUT_PATH}
+    headers:
+      X-Token: ${file:%s}
+    auth:
+      bearer: ${env:SECRET_ENV}
+
+output:
+  http:
+    url: http://localhost/node/{{.uid}}?key=${file:%s}
+    method: PUT
+    status_codes: [200]
+    headers:
+      X-Request: ${env:SECRET_ENV}-{{.original.uid}}
+`, srv.URL, secretFile, secretFile)))
+		require.NoError(t, err)
+		assert.Equal(t, srv.URL+"/nodes", plan.Input.HTTP.URL, "other variables are still expanded when parsing")
+		assert.Equal(t, "${file:"+secretFile+"}", plan.Input.HTTP.Headers["X-Token"], "secrets are only resolved when used")
+		assert.Equal(t, "${env:SECRET_ENV}", plan.Input.HTTP.Auth.Bearer)
+		_, err = Parse([]byte(`
+pipeline:
+  processors:
+    - http_lookup:
+        url: http://localhost/lookup/{{.uid}}
+        headers:
+          Authorization: ${LOOKUP_TOKEN}
+        into: lookup
+`))
+		require.NoError(t, err)
+		assert.Equal(t, "lookup "+redacted, Redact("lookup expanded-lookup-token"), "expanded lookup headers are secrets")
+
+		plan.skipReporter = true
+		plan.DryRun = true
+		plan.dir = t.TempDir()
+		require.NoError(t, plan.Run(t.Context()))
+		for _, file := range []string{requestsFile, curlFile} {
+			data, err := os.ReadFile(filepath.Join(plan.dir, file))
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), "secret-value")
+			assert.Contains(t, string(data), "http://localhost/node/1?key=REDACTED")
+			assert.Contains(t, string(data), "REDACTED-1")
+		}
+
+		var sent []string
+		out := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sent = append(sent, r.URL.Path, r.URL.Query().Get("key"), r.Header.Get("X-Request"))
+		}))
+		defer out.Close()
+		plan.Output.HTTP.URL = out.URL + "/node/{{.uid}}?key=${file:" + secretFile + "}"
+		require.NoError(t, plan.Output.Publish(t.Context(), map[string]any{"uid": "${env:SECRET_ENV}"}, map[string]any{}))
+		assert.Equal(t, []string{"/node/${env:SECRET_ENV}", "file-secret-value", "env-secret-value-${env:SECRET_ENV}"}, sent,
+			"references in messages aren't resolved")
+
+		var logs bytes.Buffer
+		logger := slog.New(NewRedactingHandler(slog.NewTextHandler(&logs, nil)))
+		logger.With("token", "env-secret-value").Error("failed with file-secret-value",
+			"err", fmt.Errorf("bad key file-secret-value"), slog.Group("request", "url", "http://localhost?key=file-secret-value"))
+		assert.NotContains(t, logs.String(), "secret-value")
+		assert.Contains(t, logs.String(), `msg="failed with REDACTED" token=REDACTED err="bad key REDACTED" request.url="http://localhost?key=REDACTED"`)
+
+		plan.Input.HTTP.Auth.Bearer = "${env:MISSING_SECRET}"
+		_, err = plan.Input.Read(t.Context())
+		require.ErrorContains(t, err, "authenticating: environment variable MISSING_SECRET isn't set")
+		plan.Input.HTTP.Headers["X-Token"] = "${file:/does/not/exist}"
+		_, err = plan.Input.Read(t.Context())
+		require.ErrorContains(t, err, "header X-Token: reading secret file")
+	})
+
+	t.Run("checkpoint outcomes", func(t *testing.T) {
+		assert.Equal(t, "conflict", Reporter{failed: "changed", conflict: true}.outcome())
+		assert.Equal(t, "filtered", Reporter{skipped: "nope"}.outcome())
+		assert.Equal(t, "published", Reporter{published: true}.outcome())
+		assert.Equal(t, "error", Reporter{published: true, failed: "boom"}.outcome())
+		assert.Empty(t, Reporter{}.outcome(), "dry runs aren't done")
+	})
+
+	t.Run("dry runs write no checkpoint", func(t *testing.T) {
+		run := func(dryRun bool) string {
+			dir := t.TempDir()
+			rs := make(chan Reporter, 1)
+			rs <- Reporter{name: "1", skipped: "nope"}
+			close(rs)
+			report(dir, rs, dryRun)
+
+			filtered, err := os.ReadFile(filepath.Join(dir, "filtered.csv"))
+			require.NoError(t, err)
+			assert.Contains(t, string(filtered), "1,nope,")
+			return dir
+		}
+
+		assert.NoFileExists(t, filepath.Join(run(true), checkpointFile))
+		finished, err := readCheckpoint(run(false))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]bool{"1": true}, finished)
+	})
+
 	t.Run("e2e", func(t *testing.T) {
 		type Config struct {
 			Enabled            bool `json:"enabled"`
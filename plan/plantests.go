@@ -0,0 +1,211 @@
+package plan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PlanTest checks what a plan's pipeline does with some input, without
+// reading the plan's input or publishing anything.
+type PlanTest struct {
+	Name string `yaml:"name"`
+	// Input is a message, or a list of messages, to run through the pipeline.
+	Input Message `yaml:"input"`
+	// Expect is the message the pipeline should emit.
+	Expect Message `yaml:"expect"`
+	// ExpectAll are the messages the pipeline should emit, in order, for
+	// pipelines that emit several.
+	ExpectAll []Message `yaml:"expect_all"`
+	// Filtered, if set, expects every input message to be filtered, with a
+	// reason that contains it.
+	Filtered string `yaml:"filtered"`
+}
+
+// ParseTests parses the tests in a plan's sibling test file, which has a
+// tests section like a plan's. Environment variables are expanded the same way
+// Parse expands them.
+func ParseTests(data []byte) ([]PlanTest, error) {
+	var file struct {
+		Tests []PlanTest `yaml:"tests"`
+	}
+	if err := yaml.Unmarshal([]byte(expandEnv(string(data))), &file); err != nil {
+		return nil, err
+	}
+	return file.Tests, nil
+}
+
+// diffPaths describes how got differs from want, one line per path.
+func diffPaths(path string, want, got Message) []string {
+	name := path
+	if name == "" {
+		name = "(message)"
+	}
+
+	wantMap, wok := want.(map[string]any)
+	gotMap, gok := got.(map[string]any)
+	if !wok || !gok {
+		if reflect.DeepEqual(want, got) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: expected %s, got %s", name, describe(want), describe(got))}
+	}
+
+	keys := make([]string, 0, len(wantMap)+len(gotMap))
+	for k := range wantMap {
+		keys = append(keys, k)
+	}
+	for k := range gotMap {
+		if _, ok := wantMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var diffs []string
+	for _, k := range keys {
+		child := k
+		if path != "" {
+			child = path + "." + k
+		}
+		w, inWant := wantMap[k]
+		g, inGot := gotMap[k]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%s: expected %s, but it's missing", child, describe(w)))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", child, describe(g)))
+		default:
+			diffs = append(diffs, diffPaths(child, w, g)...)
+		}
+	}
+	return diffs
+}
+
+// describe renders a value for a diff, as JSON would have it.
+func describe(v any) string {
+	s, err := toJSON(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return s
+}
+
+// run runs the test through the pipeline and returns what's wrong, if
+// anything.
+func (t PlanTest) run(ctx context.Context, pipeline Pipeline) ([]string, error) {
+	input, err := deepCopy(t.Input)
+	if err != nil {
+		return nil, fmt.Errorf("reading input: %w", err)
+	}
+	msgs, ok := input.([]any)
+	if !ok {
+		msgs = []any{input}
+	}
+
+	items := make([]Item, 0, len(msgs))
+	for _, msg := range msgs {
+		item, err := newItem(msg)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	// Reporters are only looked at, not written, so the batch isn't closed.
+	var b batch
+	inputs := slices.Clone(items)
+	out, err := b.processStream(ctx, pipeline.Processors, items)
+	if err != nil {
+		return nil, fmt.Errorf("processing: %w", err)
+	}
+
+	if t.Filtered != "" {
+		var problems []string
+		for _, item := range inputs {
+			switch reason := item.reporter.filterReason(); {
+			case reason == "":
+				problems = append(problems, fmt.Sprintf("%s: expected to be filtered, but it wasn't", id(item.Original)))
+			case !strings.Contains(reason, t.Filtered):
+				problems = append(problems, fmt.Sprintf("%s: expected to be filtered by %q, but was filtered by %q", id(item.Original), t.Filtered, reason))
+			}
+		}
+		return problems, nil
+	}
+
+	expected := t.ExpectAll
+	if t.Expect != nil {
+		expected = append([]Message{t.Expect}, expected...)
+	}
+	if len(out) != len(expected) {
+		problems := []string{fmt.Sprintf("expected %d messages, got %d", len(expected), len(out))}
+		for _, item := range inputs {
+			if reason := item.reporter.filterReason(); reason != "" {
+				problems = append(problems, fmt.Sprintf("%s was filtered: %s", id(item.Original), reason))
+			}
+		}
+		return problems, nil
+	}
+
+	var problems []string
+	for i, item := range out {
+		want, err := deepCopy(expected[i])
+		if err != nil {
+			return nil, fmt.Errorf("reading expected message: %w", err)
+		}
+		got, err := deepCopy(item.Message)
+		if err != nil {
+			return nil, err
+		}
+		for _, diff := range diffPaths("", want, got) {
+			if len(out) > 1 {
+				diff = fmt.Sprintf("message %d: %s", i+1, diff)
+			}
+			problems = append(problems, diff)
+		}
+	}
+	return problems, nil
+}
+
+// RunTests runs the plan's tests, writing the results to w. It returns the
+// number of tests that failed.
+func (p Plan) RunTests(ctx context.Context, w io.Writer) int {
+	if p.Client != nil {
+		ctx = WithClient(ctx, p.Client)
+	}
+	ctx, err := withClientConfig(ctx, p.HTTPClient)
+	if err != nil {
+		fmt.Fprintln(w, "FAIL", err)
+		return len(p.Tests)
+	}
+
+	failed := 0
+	for i, t := range p.Tests {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+
+		problems, err := t.run(ctx, p.Pipeline)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if len(problems) == 0 {
+			fmt.Fprintln(w, "PASS", name)
+			continue
+		}
+
+		failed++
+		fmt.Fprintln(w, "FAIL", name)
+		for _, problem := range problems {
+			fmt.Fprintln(w, "    ", problem)
+		}
+	}
+	fmt.Fprintf(w, "%d of %d tests passed\n", len(p.Tests)-failed, len(p.Tests))
+	return failed
+}
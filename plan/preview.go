@@ -0,0 +1,226 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	requestsFile = "requests.ndjson"
+	curlFile     = "requests.sh"
+
+	redacted = "REDACTED"
+)
+
+// secretHeaders are headers whose values are always redacted. Headers whose
+// names look like they hold credentials are redacted too.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// secretHeader reports whether a header's value shouldn't be written out.
+func secretHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if slices.Contains(secretHeaders, name) {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, word := range []string{"token", "secret", "key", "auth", "password"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// previewedRequest is a request a dry run would have sent, as written to
+// requests.ndjson.
+type previewedRequest struct {
+	Name        string            `json:"name"`
+	Output      string            `json:"output,omitempty"`
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+	RawBody     string            `json:"raw_body,omitempty"`
+	StatusCodes []int             `json:"status_codes,omitempty"`
+}
+
+// previewer writes the requests a dry run would have sent to the report
+// directory, both as NDJSON and as a script of curl commands.
+type previewer struct {
+	mu       sync.Mutex
+	requests *os.File
+	curl     *os.File
+}
+
+func newPreviewer(dir string) (*previewer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil { //nolint:gosec // don't care
+		return nil, fmt.Errorf("creating reports directory: %w", err)
+	}
+	requests, err := os.Create(filepath.Join(dir, requestsFile))
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", requestsFile, err)
+	}
+	curl, err := os.Create(filepath.Join(dir, curlFile))
+	if err != nil {
+		requests.Close()
+		return nil, fmt.Errorf("creating %s: %w", curlFile, err)
+	}
+	fmt.Fprintln(curl, "#!/bin/sh")
+	fmt.Fprintln(curl, "# Requests from a dry run. Redacted headers must be filled in before running.")
+	fmt.Fprintln(Progress, "requests that would be sent will be written to", dir)
+	return &previewer{requests: requests, curl: curl}, nil
+}
+
+func (pv *previewer) close() error {
+	if err := pv.requests.Close(); err != nil {
+		return err
+	}
+	return pv.curl.Close()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (pv *previewer) write(r previewedRequest, body []byte) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	var curl strings.Builder
+	fmt.Fprintf(&curl, "\n# %s\ncurl -X %s %s", r.Name, r.Method, shellQuote(r.URL))
+	keys := make([]string, 0, len(r.Headers))
+	for k := range r.Headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&curl, " \\\n  -H %s", shellQuote(k+": "+r.Headers[k]))
+	}
+	fmt.Fprintf(&curl, " \\\n  --data-binary @- <<'JSONINATOR_BODY'\n%s\nJSONINATOR_BODY\n", strings.TrimSuffix(string(body), "\n"))
+
+	// Secrets can also turn up in URLs and bodies, not just in the headers
+	// that are redacted by name.
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	if _, err := pv.requests.WriteString(Redact(string(line)) + "\n"); err != nil {
+		return err
+	}
+	_, err = pv.curl.WriteString(Redact(curl.String()))
+	return err
+}
+
+// preview renders the requests an item would have been published with, for a
+// dry run. Items are routed to outputs the same way as on a real run, but only
+// HTTP outputs are previewed.
+func (p Plan) preview(ctx context.Context, item Item) error {
+	if p.previewer == nil {
+		return nil
+	}
+	for _, out := range p.outputs() {
+		if out.HTTP.URL == "" {
+			continue
+		}
+		if out.When != nil && out.When.match(item.Message) != "" {
+			continue
+		}
+
+		req, body, err := out.newRequest(ctx, item)
+		if err != nil {
+			return fmt.Errorf("rendering request: %w", err)
+		}
+		if out.HTTP.IfMatch != nil {
+			version := "(read before publishing)"
+			if !out.HTTP.IfMatch.Read {
+				if version, err = out.version(ctx, item); err != nil {
+					return fmt.Errorf("reading version: %w", err)
+				}
+			}
+			req.Header.Set("If-Match", version)
+		}
+
+		r := previewedRequest{
+			Name:        id(item.Original),
+			Output:      out.Name,
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			Headers:     make(map[string]string, len(req.Header)),
+			StatusCodes: out.HTTP.StatusCodes,
+		}
+		for k := range req.Header {
+			r.Headers[k] = req.Header.Get(k)
+			if secretHeader(k) {
+				r.Headers[k] = redacted
+			}
+		}
+		if json.Valid(body) {
+			r.Body = json.RawMessage(strings.TrimSpace(string(body)))
+		} else {
+			r.RawBody = string(body)
+		}
+
+		slog.Info("would send request", "name", r.Name, "method", r.Method, "url", r.URL)
+		if err := p.previewer.write(r, body); err != nil {
+			return fmt.Errorf("writing request: %w", err)
+		}
+	}
+	return nil
+}
+
+// previewAll previews items in a dry run, and writes them to any file and
+// stdout outputs they're routed to. Requests that can't be rendered are
+// recorded as errors, but don't stop the run, so every mistake shows up at once.
+func (p Plan) previewAll(ctx context.Context, items []Item) {
+	for _, item := range items {
+		if err := p.preview(ctx, item); err != nil {
+			slog.Error("unable to preview request", "name", id(item.Original), "err", err)
+			if item.reporter != nil {
+				item.reporter.Fail(err)
+			}
+		}
+		for _, out := range p.outputs() {
+			if out.When != nil && out.When.match(item.Message) != "" {
+				continue
+			}
+			if err := out.publishLocal(item); err != nil {
+				slog.Error("unable to write message", "name", id(item.Original), "output", out.Name, "err", err)
+				if item.reporter != nil {
+					item.reporter.Fail(err)
+				}
+			}
+		}
+	}
+}
+
+// checkStatusCodes makes sure each HTTP output's status codes are real status
+// codes, and warns about outputs that would treat any response as a success.
+func (p Plan) checkStatusCodes() error {
+	for _, out := range p.outputs() {
+		if out.HTTP.URL == "" {
+			continue
+		}
+		for _, code := range out.HTTP.StatusCodes {
+			if code >= 100 && code <= 599 {
+				continue
+			}
+			if out.Name != "" {
+				return fmt.Errorf("output %s: invalid status code %d", out.Name, code)
+			}
+			return fmt.Errorf("output: invalid status code %d", code)
+		}
+		if len(out.HTTP.StatusCodes) == 0 {
+			slog.Warn("output has no status_codes, so any response will be treated as a success", "output", out.Name, "url", out.HTTP.URL)
+		}
+	}
+	return nil
+}
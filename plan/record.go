@@ -0,0 +1,250 @@
+package plan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+const exchangesFile = "exchanges.ndjson"
+
+// exchange is a request and the response it got, as recorded by a Recorder.
+type exchange struct {
+	Request struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers,omitempty"`
+		Body    string            `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int               `json:"status_code"`
+		Headers    map[string]string `json:"headers,omitempty"`
+		Body       string            `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+// key is what a replayed request is matched with.
+func (e exchange) key() string {
+	return e.Request.Method + " " + e.Request.URL
+}
+
+// flatten keeps the first value of each header, with headers that carry
+// credentials, in requests or responses, and known secrets masked.
+func flatten(h http.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	flat := make(map[string]string, len(h))
+	for k := range h {
+		flat[k] = Redact(h.Get(k))
+		if secretHeader(k) {
+			flat[k] = redacted
+		}
+	}
+	return flat
+}
+
+// tokenFields are the fields of a token response that hold credentials.
+var tokenFields = []string{"access_token", "refresh_token", "id_token"}
+
+// redactBody masks known secrets in a body, and the tokens in a token
+// response, which aren't known yet when it's recorded.
+func redactBody(body []byte) string {
+	var m map[string]any
+	if json.Unmarshal(body, &m) == nil {
+		found := false
+		for _, k := range tokenFields {
+			if _, ok := m[k]; ok {
+				m[k] = redacted
+				found = true
+			}
+		}
+		if found {
+			if data, err := json.Marshal(m); err == nil {
+				body = data
+			}
+		}
+	}
+	return Redact(string(body))
+}
+
+// Recorder is an http.RoundTripper that saves every exchange it sends to a
+// directory, so a run can be replayed later with a Replayer. Headers that
+// carry credentials, tokens in token responses and known secrets anywhere else
+// aren't saved.
+type Recorder struct {
+	base http.RoundTripper
+	out  *recording
+}
+
+// recording is the file exchanges are saved to, which is shared by a Recorder
+// and those made with its Wrap.
+type recording struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder returns a Recorder that sends requests with base, or
+// http.DefaultTransport if it's nil, and saves them to dir.
+func NewRecorder(dir string, base http.RoundTripper) (*Recorder, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil { //nolint:gosec // the user picks the dir
+		return nil, fmt.Errorf("creating recording directory: %w", err)
+	}
+	f, err := os.Create(filepath.Join(dir, exchangesFile))
+	if err != nil {
+		return nil, fmt.Errorf("creating recording: %w", err)
+	}
+	return &Recorder{base: base, out: &recording{f: f}}, nil
+}
+
+// Wrap returns a Recorder that sends requests with base, and saves them to the
+// same recording as r. It's meant for Plan.Transport, so recorded requests are
+// sent with the plan's http_client and client settings.
+func (r *Recorder) Wrap(base http.RoundTripper) http.RoundTripper {
+	return &Recorder{base: base, out: r.out}
+}
+
+// RoundTrip sends the request and saves the exchange.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var e exchange
+	e.Request.Method = req.Method
+	e.Request.URL = Redact(req.URL.String())
+	e.Request.Headers = flatten(req.Header)
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		e.Request.Body = redactBody(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	e.Response.StatusCode = resp.StatusCode
+	e.Response.Headers = flatten(resp.Header)
+	e.Response.Body = redactBody(body)
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	r.out.mu.Lock()
+	defer r.out.mu.Unlock()
+	if _, err := r.out.f.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("recording exchange: %w", err)
+	}
+	return resp, nil
+}
+
+// Close finishes the recording.
+func (r *Recorder) Close() error {
+	return r.out.f.Close()
+}
+
+// Replayer is an http.RoundTripper that answers requests with the responses
+// saved by a Recorder, without using the network. Requests are matched by
+// method and URL, with known secrets masked as they were when they were
+// recorded, and repeated requests get the recorded responses in order.
+// A request whose body doesn't match the recording fails, so a replayed run
+// catches changes to what would have been sent.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges map[string][]exchange
+}
+
+// NewReplayer loads the exchanges recorded in dir.
+func NewReplayer(dir string) (*Replayer, error) {
+	f, err := os.Open(filepath.Join(dir, exchangesFile)) //nolint:gosec // the user picks the dir
+	if err != nil {
+		return nil, fmt.Errorf("opening recording: %w", err)
+	}
+	defer f.Close()
+
+	r := &Replayer{exchanges: make(map[string][]exchange)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var e exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("reading recording: %w", err)
+		}
+		r.exchanges[e.key()] = append(r.exchanges[e.key()], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading recording: %w", err)
+	}
+	return r, nil
+}
+
+// sameBody compares request bodies, as JSON if they both are.
+func sameBody(recorded, sent string) bool {
+	var a, b any
+	if json.Unmarshal([]byte(recorded), &a) == nil && json.Unmarshal([]byte(sent), &b) == nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return recorded == sent
+}
+
+// RoundTrip answers the request with the next recorded response for it.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := req.Method + " " + Redact(req.URL.String())
+	r.mu.Lock()
+	recorded := r.exchanges[key]
+	if len(recorded) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s", key)
+	}
+	e := recorded[0]
+	r.exchanges[key] = recorded[1:]
+	r.mu.Unlock()
+
+	if sent := redactBody(body); !sameBody(e.Request.Body, sent) {
+		return nil, fmt.Errorf("request body for %s doesn't match the recording: sent %s, recorded %s", key, sent, e.Request.Body)
+	}
+
+	header := make(http.Header, len(e.Response.Headers))
+	for k, v := range e.Response.Headers {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Response.StatusCode, http.StatusText(e.Response.StatusCode)),
+		StatusCode:    e.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(e.Response.Body))),
+		ContentLength: int64(len(e.Response.Body)),
+		Request:       req,
+	}, nil
+}
@@ -8,9 +8,24 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// routing is the outcome of publishing a message to one of a plan's named
+// outputs.
+type routing struct {
+	output  string
+	outcome string
+	detail  string
+}
+
+// childSkip is why a message split from the reporter's message was filtered.
+type childSkip struct {
+	name   string
+	reason string
+}
+
 type change struct {
 	name   string
 	before any
@@ -20,9 +35,20 @@ type change struct {
 var reports = make(chan Reporter)
 
 type Reporter struct {
-	name    string
-	changes []change
-	skipped string
+	name       string
+	changes    []change
+	drifts     []change
+	routings   []routing
+	skipped    string
+	childSkips []childSkip // messages split from this one that were filtered
+	failed     string
+	unverified string
+	published  bool
+	unchanged  bool
+	conflict   bool
+	notRun     bool
+	wave       int
+	closed     bool
 }
 
 func NewReporter(name string) *Reporter {
@@ -44,6 +70,127 @@ func (r *Reporter) Skip(filter string) {
 	r.skipped = filter
 }
 
+// adopt records what the pipeline did to a message split from this reporter's
+// message, as recorded on the child's own reporter: why it was filtered, or the
+// changes made to it if it wasn't.
+func (r *Reporter) adopt(child *Reporter, name string) {
+	r.childSkips = append(r.childSkips, child.childSkips...)
+	if child.skipped != "" {
+		r.childSkips = append(r.childSkips, childSkip{name: name, reason: child.skipped})
+		return
+	}
+	r.changes = append(r.changes, child.changes...)
+}
+
+// filterReason is why the message was filtered: its own filter, or those of
+// the messages split from it if they were all filtered.
+func (r Reporter) filterReason() string {
+	if r.skipped != "" || r.childSkips == nil {
+		return r.skipped
+	}
+	reasons := make([]string, 0, len(r.childSkips))
+	for _, s := range r.childSkips {
+		reasons = append(reasons, s.String())
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func (s childSkip) String() string {
+	if s.name == "" {
+		return s.reason
+	}
+	return s.name + ": " + s.reason
+}
+
+// stop records that the message wasn't published because the rollout stopped
+// before its wave. It's reported with the filtered messages, but isn't done,
+// so it's published if the run is resumed.
+func (r *Reporter) stop(reason string) {
+	r.skipped = reason
+	r.notRun = true
+}
+
+// Fail records that publishing the message failed.
+func (r *Reporter) Fail(err error) {
+	r.failed = err.Error()
+}
+
+// Unverified records that the message was published, but couldn't be read back
+// to verify it.
+func (r *Reporter) Unverified(err error) {
+	r.unverified = err.Error()
+}
+
+// Conflict records that publishing the message failed because its target
+// changed since its version was read.
+func (r *Reporter) Conflict(err error) {
+	r.failed = err.Error()
+	r.conflict = true
+}
+
+// Publish records that the message was published.
+func (r *Reporter) Publish() {
+	r.published = true
+}
+
+// outcome is where the message ended up, as recorded in the checkpoint.
+// Messages without an outcome, such as those in a dry run, aren't done and
+// will be processed again if the run is resumed.
+func (r Reporter) outcome() string {
+	switch {
+	case r.conflict:
+		return outcomeConflict
+	case r.failed != "":
+		return outcomeError
+	case r.notRun:
+		return outcomeNotRun
+	case r.unverified != "":
+		return outcomeUnverified
+	case r.drifts != nil:
+		return outcomeDrifted
+	case r.unchanged:
+		return outcomeUnchanged
+	case r.published:
+		return outcomePublished
+	case r.skipped != "" || r.childSkips != nil:
+		return outcomeFiltered
+	}
+	return ""
+}
+
+// Routed records the outcome of publishing the message to a named output, with
+// the reason it was filtered or the error it failed with. Nothing is recorded
+// for a plan's only output, which has no name.
+func (r *Reporter) Routed(output, outcome, detail string) {
+	if output == "" {
+		return
+	}
+	r.routings = append(r.routings, routing{output: output, outcome: outcome, detail: detail})
+}
+
+// Unchanged records that the message wasn't published because it wouldn't
+// have changed anything.
+func (r *Reporter) Unchanged() {
+	r.unchanged = true
+}
+
+// Drift records that a field didn't have the value that was published when
+// it was read back.
+func (r *Reporter) Drift(name string, sent any, actual any) {
+	r.drifts = append(r.drifts, change{
+		name:   name,
+		before: sent,
+		after:  actual,
+	})
+}
+
+// discard drops the reporter without writing it, for messages an interrupted
+// run never got to. They aren't recorded in the checkpoint, so they'll run if
+// the run is resumed.
+func (r *Reporter) discard() {
+	r.closed = true
+}
+
 func (r *Reporter) Change(name string, before any, after any) {
 	r.changes = append(r.changes, change{
 		name:   name,
@@ -52,7 +199,13 @@ func (r *Reporter) Change(name string, before any, after any) {
 	})
 }
 
+// Close sends the reporter's findings to be written to the reports. Only the
+// first call has any effect.
 func (r *Reporter) Close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
 	reports <- *r
 }
 
@@ -60,18 +213,70 @@ func closeReporters() {
 	close(reports)
 }
 
-func report(ctx context.Context) {
+const (
+	checkpointFile = "checkpoint.csv"
+
+	outcomePublished  = "published"
+	outcomeFiltered   = "filtered"
+	outcomeError      = "error"
+	outcomeDrifted    = "drifted"
+	outcomeUnchanged  = "unchanged"
+	outcomeConflict   = "conflict"
+	outcomeNotRun     = "not run"
+	outcomeUnverified = "unverified"
+)
+
+// reportDir picks a new directory for a run's reports.
+func reportDir() string {
 	stamp := fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), rand.Int()) //nolint:gosec // don't care
-	dir := filepath.Join("reports", stamp)
+	return filepath.Join("reports", stamp)
+}
+
+// readCheckpoint returns the names of messages that a previous run in dir
+// finished with, which are those that were published or filtered, including
+// those that were published but couldn't be verified. Messages
+// that errored, hit a conflict or were never reached by a rollout are retried.
+func readCheckpoint(dir string) (map[string]bool, error) {
+	f, err := os.Open(filepath.Join(dir, checkpointFile)) //nolint:gosec // the user picks the dir to resume
+	if err != nil {
+		return nil, fmt.Errorf("opening checkpoint: %w", err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+
+	done := make(map[string]bool)
+	for _, record := range records[min(1, len(records)):] {
+		if len(record) < 2 {
+			continue
+		}
+		switch record[1] {
+		case outcomePublished, outcomeFiltered, outcomeDrifted, outcomeUnchanged, outcomeUnverified:
+			done[record[0]] = true
+		case outcomeError, outcomeConflict, outcomeNotRun:
+			delete(done, record[0])
+		}
+	}
+	return done, nil
+}
+
+// report writes reporters to the CSV files in dir as they're received. If the
+// files already exist, as when a run is resumed, they're appended to. A dry run
+// publishes nothing, so it writes no checkpoint, which would otherwise have a
+// later run resumed from dir skip messages it had filtered.
+func report(dir string, reports <-chan Reporter, dryRun bool) {
 	if err := os.MkdirAll(dir, 0755); err != nil { //nolint:gosec // don't care
 		slog.Error("unable to create reports directory", "err", err)
 		panic(err)
 	}
 
-	fmt.Println("reports will be written to", dir)
+	fmt.Fprintln(Progress, "reports will be written to", dir)
 
 	mkfile := func(name string) *os.File {
-		f, err := os.Create(filepath.Join(dir, name)) //nolint:gosec // we control this path...
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644) //nolint:gosec // we control this path...
 		if err != nil {
 			slog.Error("unable to create report file", "name", name, "dir", dir, "err", err)
 			panic(err)
@@ -82,46 +287,119 @@ func report(ctx context.Context) {
 	filterFile := mkfile("filtered.csv")
 	changeFile := mkfile("changes.csv")
 	noopFile := mkfile("noops.csv")
+	errorFile := mkfile("errors.csv")
+	driftFile := mkfile("drifted.csv")
+	unchangedFile := mkfile("unchanged.csv")
+	conflictFile := mkfile("conflicts.csv")
+	unverifiedFile := mkfile("unverified.csv")
+	outputFile := mkfile("outputs.csv")
 	defer filterFile.Close()
 	defer changeFile.Close()
 	defer noopFile.Close()
+	defer errorFile.Close()
+	defer driftFile.Close()
+	defer unchangedFile.Close()
+	defer conflictFile.Close()
+	defer unverifiedFile.Close()
+	defer outputFile.Close()
 
 	filterCSV := csv.NewWriter(filterFile)
 	changeCSV := csv.NewWriter(changeFile)
 	noopCSV := csv.NewWriter(noopFile)
-	defer filterCSV.Flush()
-	defer changeCSV.Flush()
-	defer noopCSV.Flush()
+	errorCSV := csv.NewWriter(errorFile)
+	driftCSV := csv.NewWriter(driftFile)
+	unchangedCSV := csv.NewWriter(unchangedFile)
+	conflictCSV := csv.NewWriter(conflictFile)
+	unverifiedCSV := csv.NewWriter(unverifiedFile)
+	outputCSV := csv.NewWriter(outputFile)
 
+	// Records are flushed as they're written, so the reports can be inspected
+	// while a rollout is paused between waves.
 	writeCSV := func(w *csv.Writer, record []string) {
+		for i, field := range record {
+			record[i] = Redact(field)
+		}
 		if err := w.Write(record); err != nil {
 			slog.Error("unable to write report record", "record", record, "err", err)
 		}
+		w.Flush()
 	}
 
-	writeCSV(filterCSV, []string{"name", "filter"})
-	writeCSV(changeCSV, []string{"name", "field", "before", "after"})
-	writeCSV(noopCSV, []string{"name"})
+	writeHeader := func(f *os.File, w *csv.Writer, header []string) {
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			return
+		}
+		writeCSV(w, header)
+	}
 
-	for {
-		select {
-		case r, ok := <-reports:
-			if !ok {
-				return
-			}
-			switch {
-			case r.skipped != "":
-				writeCSV(filterCSV, []string{r.name, r.skipped})
-			case r.changes != nil:
-				for _, c := range r.changes {
-					writeCSV(changeCSV, []string{r.name, c.name, fmt.Sprintf("%v", c.before), fmt.Sprintf("%v", c.after)})
-				}
-			default:
-				writeCSV(noopCSV, []string{r.name})
+	writeHeader(filterFile, filterCSV, []string{"name", "filter", "wave"})
+	writeHeader(changeFile, changeCSV, []string{"name", "field", "before", "after", "wave"})
+	writeHeader(noopFile, noopCSV, []string{"name", "wave"})
+	writeHeader(errorFile, errorCSV, []string{"name", "error", "wave"})
+	writeHeader(driftFile, driftCSV, []string{"name", "field", "sent", "actual", "wave"})
+	writeHeader(unchangedFile, unchangedCSV, []string{"name", "wave"})
+	writeHeader(conflictFile, conflictCSV, []string{"name", "error", "wave"})
+	writeHeader(unverifiedFile, unverifiedCSV, []string{"name", "error", "wave"})
+	writeHeader(outputFile, outputCSV, []string{"name", "output", "outcome", "detail", "wave"})
+
+	var checkpointCSV *csv.Writer
+	if !dryRun {
+		checkpoint := mkfile(checkpointFile)
+		defer checkpoint.Close()
+		checkpointCSV = csv.NewWriter(checkpoint)
+		writeHeader(checkpoint, checkpointCSV, []string{"name", "outcome"})
+	}
+
+	unchanged := 0
+	defer func() {
+		if unchanged > 0 {
+			fmt.Fprintln(Progress, unchanged, "messages were already up to date and weren't published")
+		}
+	}()
+
+	// Reports keep being written until every reporter is closed, even if the
+	// run is interrupted, so nothing is lost on shutdown.
+	for r := range reports {
+		if outcome := r.outcome(); outcome != "" && checkpointCSV != nil {
+			writeCSV(checkpointCSV, []string{r.name, outcome})
+		}
+
+		wave := ""
+		if r.wave > 0 {
+			wave = fmt.Sprint(r.wave)
+		}
+		for _, o := range r.routings {
+			writeCSV(outputCSV, []string{r.name, o.output, o.outcome, o.detail, wave})
+		}
+		for _, s := range r.childSkips {
+			writeCSV(filterCSV, []string{r.name, s.String(), wave})
+		}
+		if r.unverified != "" {
+			writeCSV(unverifiedCSV, []string{r.name, r.unverified, wave})
+		}
+		for _, d := range r.drifts {
+			writeCSV(driftCSV, []string{r.name, d.name, fmt.Sprintf("%v", d.before), fmt.Sprintf("%v", d.after), wave})
+		}
+
+		switch {
+		case r.skipped != "":
+			writeCSV(filterCSV, []string{r.name, r.skipped, wave})
+		case r.conflict:
+			writeCSV(conflictCSV, []string{r.name, r.failed, wave})
+		case r.failed != "":
+			writeCSV(errorCSV, []string{r.name, r.failed, wave})
+		case r.unchanged:
+			unchanged++
+			writeCSV(unchangedCSV, []string{r.name, wave})
+		case r.changes != nil:
+			for _, c := range r.changes {
+				writeCSV(changeCSV, []string{r.name, c.name, fmt.Sprintf("%v", c.before), fmt.Sprintf("%v", c.after), wave})
 			}
-		case <-ctx.Done():
-			slog.Info("reporter exiting")
-			return
+		case r.childSkips != nil:
+			// Every message split from this one was filtered, which is
+			// already recorded.
+		default:
+			writeCSV(noopCSV, []string{r.name, wave})
 		}
 	}
 }
@@ -0,0 +1,195 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const rollbackFile = "rollback.yaml"
+
+// Rollback captures each message's state before it's published during a real
+// run, and writes a plan to the report directory that puts it all back.
+type Rollback struct {
+	// Capture is where the state before the change comes from. "original"
+	// (the default) uses the message as it was before the pipeline changed it,
+	// and "fetch" GETs the output URL just before publishing.
+	Capture string `yaml:"capture"`
+}
+
+type rollbackEntry struct {
+	URL  string  `json:"url"`
+	Body Message `json:"body"`
+}
+
+// rollbackRecorder collects the captured states over the course of a run.
+type rollbackRecorder struct {
+	entries []rollbackEntry
+}
+
+// captureBefore captures the state of the resource an item is about to be
+// published to. It's only added to the rollback plan once the publish
+// succeeds, so failed publishes aren't rolled back.
+func (p Plan) captureBefore(ctx context.Context, item Item) (*rollbackEntry, error) {
+	url, err := p.Output.url(item.Original)
+	if err != nil {
+		return nil, err
+	}
+
+	before := item.Before
+	if p.Rollback.Capture == "fetch" {
+		if before, err = p.Output.fetch(ctx, url, item); err != nil {
+			return nil, fmt.Errorf("capturing state for rollback: %w", err)
+		}
+	}
+	if before == nil {
+		slog.Warn("no state to capture for rollback", "url", url)
+		return nil, nil
+	}
+	return &rollbackEntry{URL: url, Body: before}, nil
+}
+
+// readRollback reads the captured states from a rollback plan written by an
+// earlier run in the same directory, if there is one.
+func readRollback(path string) ([]rollbackEntry, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // the path is in the report dir
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plan, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	var entries []rollbackEntry
+	if err := json.Unmarshal([]byte(plan.Input.Raw), &entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// writeRollback writes a plan that sends each captured state back to where it
+// came from. Headers, auth and HTTP clients are written as they were in the
+// plan file, before environment variables were expanded, so secrets don't end
+// up in the reports.
+//
+// A resumed run adds to the rollback plan of the run it resumes. Only the
+// first state captured for each URL is kept, since that's the one from before
+// any of the runs changed it.
+func (p Plan) writeRollback() error {
+	if len(p.rollback.entries) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(p.dir, rollbackFile)
+	entries, err := readRollback(path)
+	if err != nil {
+		return err
+	}
+	captured := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		captured[e.URL] = true
+	}
+	for _, e := range p.rollback.entries {
+		if !captured[e.URL] {
+			captured[e.URL] = true
+			entries = append(entries, e)
+		}
+	}
+
+	raw, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	headers := p.rawOutputHeaders
+	if headers == nil {
+		headers = p.Output.HTTP.Headers
+	}
+	auth := p.rawOutputAuth
+	if auth == nil {
+		auth = p.Output.HTTP.Auth
+	}
+	client := p.rawOutputClient
+	if client == nil {
+		client = p.Output.HTTP.Client
+	}
+	httpClient := p.rawHTTPClient
+	if httpClient == nil {
+		httpClient = p.HTTPClient
+	}
+
+	// Captured states are whole resources, so a patch would leave fields the
+	// run added in place. They're PUT back in full instead.
+	method := p.Output.HTTP.Method
+	if body := p.Output.HTTP.Body; body != "" && body != "full" {
+		method = http.MethodPut
+		full := make(map[string]string, len(headers)+1)
+		for k, v := range headers {
+			if !strings.EqualFold(k, "Content-Type") {
+				full[k] = v
+			}
+		}
+		full["Content-Type"] = "application/json"
+		headers = full
+	}
+
+	type rollbackHTTP struct {
+		URL         string            `yaml:"url"`
+		Method      string            `yaml:"method"`
+		Headers     map[string]string `yaml:"headers,omitempty"`
+		Auth        *Auth             `yaml:"auth,omitempty"`
+		StatusCodes []int             `yaml:"status_codes,flow,omitempty"`
+		Client      *HTTPClient       `yaml:"client,omitempty"`
+	}
+	var plan struct {
+		Input struct {
+			Raw string `yaml:"raw"`
+		} `yaml:"input"`
+		Pipeline struct {
+			Processors []map[string]map[string]string `yaml:"processors"`
+		} `yaml:"pipeline"`
+		Output struct {
+			HTTP rollbackHTTP `yaml:"http"`
+		} `yaml:"output"`
+		HTTPClient *HTTPClient `yaml:"http_client,omitempty"`
+	}
+	// The captured states are data, which mustn't be expanded like the rest
+	// of the plan when it's parsed.
+	plan.Input.Raw = escapeEnv(string(raw)) + "\n"
+	plan.Pipeline.Processors = []map[string]map[string]string{{"map": {"field": "body"}}}
+	plan.Output.HTTP = rollbackHTTP{
+		URL:         "{{.url}}",
+		Method:      method,
+		Headers:     headers,
+		Auth:        auth,
+		StatusCodes: p.Output.HTTP.StatusCodes,
+		Client:      client,
+	}
+	plan.HTTPClient = httpClient
+
+	data, err := yaml.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil { //nolint:gosec // don't care
+		return err
+	}
+
+	header := fmt.Sprintf("# Rolls back the %d messages published by the run in %s\n", len(entries), p.dir)
+	if err := os.WriteFile(path, append([]byte(header), data...), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintln(Progress, "rollback plan written to", path)
+	return nil
+}
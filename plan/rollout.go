@@ -0,0 +1,147 @@
+package plan
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Rollout publishes messages in waves rather than all at once, pausing for
+// confirmation between waves.
+type Rollout struct {
+	// Waves are the sizes of each wave, either a number of messages or a
+	// percentage of all messages, eg "10%". Any messages left over after the
+	// last wave are published in one final wave.
+	Waves []string `yaml:"waves"`
+	// MaxErrorPercent stops the rollout after any wave where more than this
+	// percentage of publishes failed. It's ignored if zero.
+	MaxErrorPercent float64 `yaml:"max_error_percent"`
+}
+
+// sizes works out how many messages are in each wave.
+func (r Rollout) sizes(total int) ([]int, error) {
+	var sizes []int
+	remaining := total
+	for _, wave := range r.Waves {
+		var size int
+		if pct, ok := strings.CutSuffix(strings.TrimSpace(wave), "%"); ok {
+			f, err := strconv.ParseFloat(pct, 64)
+			if err != nil || f <= 0 {
+				return nil, fmt.Errorf("invalid wave size %q", wave)
+			}
+			size = int(math.Ceil(float64(total) * f / 100))
+		} else {
+			n, err := strconv.Atoi(strings.TrimSpace(wave))
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid wave size %q", wave)
+			}
+			size = n
+		}
+
+		size = min(size, remaining)
+		if size == 0 {
+			break
+		}
+		sizes = append(sizes, size)
+		remaining -= size
+	}
+	if remaining > 0 {
+		sizes = append(sizes, remaining)
+	}
+	return sizes, nil
+}
+
+// skipRemaining records messages that weren't published because the rollout
+// stopped, so they're published if the run is resumed.
+func skipRemaining(items []Item, reason string) {
+	for _, item := range items {
+		if item.reporter != nil {
+			item.reporter.stop(reason)
+		}
+	}
+}
+
+// runRollout is used when the plan has rollout waves. Every message is run
+// through the whole pipeline first, so wave sizes are known, and then each wave
+// is published in turn. Unlike other runs, a failed publish doesn't stop the
+// run; it's recorded and counted against the wave's error rate.
+func (p Plan) runRollout(ctx context.Context, msgs []Message) error {
+	var b batch
+	defer b.close(ctx)
+
+	items, err := newItems(msgs)
+	if err != nil {
+		return err
+	}
+	items, err = b.processStream(ctx, p.Pipeline.Processors, items)
+	if err != nil {
+		return fmt.Errorf("processing messages: %w", err)
+	}
+
+	sizes, err := p.Rollout.sizes(len(items))
+	if err != nil {
+		return fmt.Errorf("planning rollout: %w", err)
+	}
+
+	// Each reporter is closed once the wave with its last message is done.
+	last := b.lastUses(items)
+
+	// Every message is given its wave up front, so messages in waves the
+	// rollout never reaches are reported with the wave they'd have been in.
+	// Messages split from the same input are reported with their first wave.
+	start := 0
+	for w, size := range sizes {
+		for _, item := range items[start : start+size] {
+			if item.reporter != nil && item.reporter.wave == 0 {
+				item.reporter.wave = w + 1
+			}
+		}
+		start += size
+	}
+
+	start = 0
+	for w, size := range sizes {
+		wave := w + 1
+		failed := 0
+		for i := start; i < start+size; i++ {
+			if ctx.Err() != nil {
+				return interrupted(ctx, items[i:])
+			}
+			item := items[i]
+			if p.DryRun {
+				p.previewAll(ctx, []Item{item})
+				continue
+			}
+			if err := p.publish(ctx, item); err != nil {
+				slog.Error("unable to publish message", "name", id(item.Original), "wave", wave, "err", err)
+				failed++
+			}
+		}
+		for i := start; i < start+size; i++ {
+			if r := items[i].reporter; r != nil && last[r] == i {
+				r.Close()
+			}
+		}
+		start += size
+
+		fmt.Fprintf(Progress, "Wave %d of %d: %d messages, %d failed\n", wave, len(sizes), size, failed)
+		if p.Rollout.MaxErrorPercent > 0 && float64(failed)*100/float64(size) > p.Rollout.MaxErrorPercent {
+			skipRemaining(items[start:], fmt.Sprintf("rollout stopped after wave %d", wave))
+			return fmt.Errorf("rollout stopped after wave %d: %d of %d publishes failed", wave, failed, size)
+		}
+
+		if start == len(items) || p.DryRun || p.Confirm == nil {
+			continue
+		}
+		if !p.Confirm(fmt.Sprintf("Continue with wave %d of %d (%d messages)?", wave+1, len(sizes), sizes[w+1])) {
+			skipRemaining(items[start:], fmt.Sprintf("rollout stopped before wave %d", wave+1))
+			fmt.Fprintln(Progress, "Rollout stopped before wave", wave+1)
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package plan
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// secretRef matches a ${file:/path} or ${env:NAME} reference. References are
+// left alone when a plan is parsed, and only resolved when the value is used,
+// so the secrets they point to aren't kept in the parsed plan.
+var secretRef = regexp.MustCompile(`\$\{(file|env):([^}]+)\}`)
+
+// expandEnv expands ${VAR} and $VAR like os.ExpandEnv, but leaves secret
+// references to be resolved later. $$ is a literal $.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		if strings.HasPrefix(name, "file:") || strings.HasPrefix(name, "env:") {
+			return "${" + name + "}"
+		}
+		return os.Getenv(name)
+	})
+}
+
+// resolve replaces the secret references in s with what they point to. Files
+// are read every time, so rotated secrets are picked up, and a trailing
+// newline is dropped. Resolved values are redacted from then on.
+func resolve(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	resolved := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		var value string
+		switch m[1] {
+		case "file":
+			data, readErr := os.ReadFile(m[2])
+			if readErr != nil {
+				err = fmt.Errorf("reading secret file: %w", readErr)
+				return ref
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		case "env":
+			v, ok := os.LookupEnv(m[2])
+			if !ok {
+				err = fmt.Errorf("environment variable %s isn't set", m[2])
+				return ref
+			}
+			value = v
+		}
+		addSecret(value)
+		return value
+	})
+	return resolved, err
+}
+
+// escapeEnv escapes data that's written into a plan, so expandEnv leaves it as
+// it is when the plan is parsed.
+func escapeEnv(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// secretTemplate rewrites the secret references in a template from the plan
+// into calls to resolve, so they're resolved when the template is executed.
+// Text the template renders from messages is never resolved, so message data
+// can't pull secrets out of the host.
+func secretTemplate(text string) string {
+	return secretRef.ReplaceAllStringFunc(text, func(ref string) string {
+		return "{{resolve " + strconv.Quote(ref) + "}}"
+	})
+}
+
+// resolveBody resolves the secret references in the strings of a request body.
+func resolveBody(body any) (any, error) {
+	switch body := body.(type) {
+	case string:
+		return resolve(body)
+	case map[string]any:
+		resolved := make(map[string]any, len(body))
+		for k, v := range body {
+			r, err := resolveBody(v)
+			if err != nil {
+				return nil, err
+			}
+			resolved[k] = r
+		}
+		return resolved, nil
+	case []any:
+		resolved := make([]any, len(body))
+		for i, v := range body {
+			r, err := resolveBody(v)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	}
+	return body, nil
+}
+
+// minSecretLength is the shortest value that's redacted. Shorter ones would
+// mask too much that isn't secret.
+const minSecretLength = 4
+
+var secrets = struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}{values: make(map[string]bool)}
+
+// addSecret redacts a value from logs, reports and dry-run requests.
+func addSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	if secrets.values[value] {
+		return
+	}
+	secrets.values[value] = true
+	// Longer values go first, so a secret that contains another is masked
+	// whole.
+	values := slices.Collect(maps.Keys(secrets.values))
+	slices.SortFunc(values, func(a, b string) int { return len(b) - len(a) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, redacted)
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// addSecrets redacts the values of secret headers and the credentials of auth,
+// as they were after expanding environment variables.
+func addSecrets(headers map[string]string, auth *Auth) {
+	for k, v := range headers {
+		if secretHeader(k) {
+			addSecret(strings.TrimPrefix(strings.TrimPrefix(v, "Bearer "), "Basic "))
+		}
+	}
+	if auth == nil {
+		return
+	}
+	addSecret(auth.Bearer)
+	if auth.Basic != nil {
+		addSecret(auth.Basic.Password)
+	}
+	if auth.OAuth2 != nil {
+		addSecret(auth.OAuth2.ClientSecret)
+	}
+}
+
+// Redact masks the known secret values in s.
+func Redact(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// redactingHandler is a slog.Handler that masks known secret values in the
+// message and attributes of each record.
+type redactingHandler struct {
+	handler slog.Handler
+}
+
+// NewRedactingHandler returns a handler that masks known secret values before
+// passing records on to h.
+func NewRedactingHandler(h slog.Handler) slog.Handler {
+	return redactingHandler{handler: h}
+}
+
+func (h redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.handler.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	masked := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		masked[i] = redactAttr(a)
+	}
+	return redactingHandler{handler: h.handler.WithAttrs(masked)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{handler: h.handler.WithGroup(name)}
+}
+
+// redactAttr masks known secret values in an attribute. Values that aren't
+// strings are only replaced, with their redacted text, if they contain one.
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		masked := make([]any, len(group))
+		for i, g := range group {
+			masked[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, masked...)
+	case slog.KindAny:
+		s := fmt.Sprint(v.Any())
+		if r := Redact(s); r != s {
+			return slog.String(a.Key, r)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
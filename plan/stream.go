@@ -0,0 +1,387 @@
+package plan
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// GroupBy collects messages that share a key into one combined message per
+// group. It's a Stage, so groups are only emitted once every message has
+// reached it.
+type GroupBy struct {
+	// Key is a template evaluated against each message. Messages that render
+	// the same key are grouped together.
+	Key string `yaml:"key"`
+	// Fields maps each field of the combined message to the reducer that
+	// produces it.
+	Fields map[string]Reducer `yaml:"fields"`
+}
+
+// reducerOps are the reducers a group_by field can use.
+var reducerOps = []string{"collect", "count", "sum", "first", "last"}
+
+// Reducer combines a value across every message in a group.
+type Reducer struct {
+	// Op is one of collect, count, sum, first or last.
+	Op string `yaml:"op"`
+	// Field is the dot path of the value to reduce. If it's empty, collect,
+	// first and last use the whole message, and count counts every message.
+	Field string `yaml:"field"`
+}
+
+func (r Reducer) values(msgs []Message) []Message {
+	if r.Field == "" {
+		return msgs
+	}
+	values := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if v, ok := dive(msg, strings.Split(r.Field, ".")); ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (r Reducer) reduce(msgs []Message) (any, error) {
+	values := r.values(msgs)
+	switch r.Op {
+	case "collect":
+		collected := make([]any, 0, len(values))
+		for _, v := range values {
+			collected = append(collected, v)
+		}
+		return collected, nil
+	case "count":
+		return float64(len(values)), nil
+	case "sum":
+		var sum float64
+		for _, v := range values {
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("sum of %q: %v is not a number", r.Field, v)
+			}
+			sum += f
+		}
+		return sum, nil
+	case "first":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	case "last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[len(values)-1], nil
+	}
+	return nil, fmt.Errorf("unknown reducer: %q", r.Op)
+}
+
+// check makes sure the key template parses and every reducer is known, so a
+// mistake is caught before any message has been processed.
+func (g GroupBy) check() error {
+	if _, err := template.New("group_by").Funcs(templateFuncs).Parse(g.Key); err != nil {
+		return fmt.Errorf("parsing key template: %w", err)
+	}
+	for field, reducer := range g.Fields {
+		if !slices.Contains(reducerOps, reducer.Op) {
+			return fmt.Errorf("field %q: unknown reducer %q, expected one of %s", field, reducer.Op, strings.Join(reducerOps, ", "))
+		}
+	}
+	return nil
+}
+
+// ProcessStream implements the Stage interface for GroupBy. Each group is
+// emitted as an object with the group's key under "key" and a field for each
+// reducer, in the order the groups were first seen. Output templates for a
+// group have the combined message as their data context.
+func (g GroupBy) ProcessStream(_ context.Context, items []Item) ([]Item, error) {
+	tmpl, err := template.New("group_by").Funcs(templateFuncs).Parse(g.Key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	var keys []string
+	groups := make(map[string][]Message)
+	for _, item := range items {
+		key, err := renderKey(tmpl, item.Message)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item.Message)
+	}
+
+	grouped := make([]Item, 0, len(keys))
+	for _, key := range keys {
+		msg := map[string]any{"key": key}
+		for field, reducer := range g.Fields {
+			v, err := reducer.reduce(groups[key])
+			if err != nil {
+				return nil, fmt.Errorf("reducing field %q for group %q: %w", field, key, err)
+			}
+			msg[field] = v
+		}
+
+		original, err := deepCopy(msg)
+		if err != nil {
+			return nil, fmt.Errorf("making deep copy of message: %w", err)
+		}
+		grouped = append(grouped, Item{Original: original, Message: msg, reporter: NewReporter(key)})
+	}
+
+	return grouped, nil
+}
+
+// Process implements the Processor interface for GroupBy, treating the message
+// as a group of one.
+func (g GroupBy) Process(ctx context.Context, data Message) (Message, error) {
+	return processOne(ctx, g, data)
+}
+
+// processOne runs a single message through a stage, as a stream of one.
+func processOne(ctx context.Context, stage Stage, data Message) (Message, error) {
+	reporter, _ := ctx.Value(reporterKey).(*Reporter)
+	items, err := stage.ProcessStream(ctx, []Item{{Original: data, Message: data, reporter: reporter}})
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0].Message, nil
+}
+
+// renderKey evaluates a stage's key template against a message.
+func renderKey(tmpl *template.Template, msg Message) (string, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, msg); err != nil {
+		return "", fmt.Errorf("executing template: %w", err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// skipDropped records why items were dropped from a stream. Messages split
+// from the same input share a reporter, so a reporter is only marked as
+// skipped if none of its items were kept.
+func skipDropped(kept, dropped []Item, reason func(Item) string) {
+	keptReporters := make(map[*Reporter]bool, len(kept))
+	for _, item := range kept {
+		keptReporters[item.reporter] = true
+	}
+	for _, item := range dropped {
+		if item.reporter != nil && !keptReporters[item.reporter] {
+			item.reporter.Skip(reason(item))
+		}
+	}
+}
+
+// Dedupe drops messages whose key has already been seen, keeping the first.
+type Dedupe struct {
+	// Key is a template evaluated against each message.
+	Key string `yaml:"key"`
+}
+
+// ProcessStream implements the Stage interface for Dedupe.
+func (d Dedupe) ProcessStream(_ context.Context, items []Item) ([]Item, error) {
+	tmpl, err := template.New("dedupe").Funcs(templateFuncs).Parse(d.Key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	seen := make(map[string]bool, len(items))
+	var kept, dropped []Item
+	for _, item := range items {
+		key, err := renderKey(tmpl, item.Message)
+		if err != nil {
+			return nil, err
+		}
+		if seen[key] {
+			dropped = append(dropped, item)
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, item)
+	}
+
+	skipDropped(kept, dropped, func(item Item) string {
+		key, _ := renderKey(tmpl, item.Message)
+		return fmt.Sprintf("duplicate of key %q", key)
+	})
+	return kept, nil
+}
+
+// Process implements the Processor interface for Dedupe.
+func (d Dedupe) Process(ctx context.Context, data Message) (Message, error) {
+	return processOne(ctx, d, data)
+}
+
+// Sort orders messages by a key. Keys that are both numbers are compared
+// numerically, and anything else is compared as text. The sort is stable, so
+// messages with equal keys keep their order.
+type Sort struct {
+	// Key is a template evaluated against each message.
+	Key string `yaml:"key"`
+	// Descending reverses the order.
+	Descending bool `yaml:"descending"`
+}
+
+func compareKeys(a, b string) int {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		return cmp.Compare(fa, fb)
+	}
+	return strings.Compare(a, b)
+}
+
+// ProcessStream implements the Stage interface for Sort.
+func (s Sort) ProcessStream(_ context.Context, items []Item) ([]Item, error) {
+	tmpl, err := template.New("sort").Funcs(templateFuncs).Parse(s.Key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	type keyed struct {
+		key  string
+		item Item
+	}
+	sorted := make([]keyed, 0, len(items))
+	for _, item := range items {
+		key, err := renderKey(tmpl, item.Message)
+		if err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, keyed{key: key, item: item})
+	}
+
+	slices.SortStableFunc(sorted, func(a, b keyed) int {
+		if s.Descending {
+			return compareKeys(b.key, a.key)
+		}
+		return compareKeys(a.key, b.key)
+	})
+
+	out := make([]Item, 0, len(sorted))
+	for _, k := range sorted {
+		out = append(out, k.item)
+	}
+	return out, nil
+}
+
+// Process implements the Processor interface for Sort.
+func (s Sort) Process(ctx context.Context, data Message) (Message, error) {
+	return processOne(ctx, s, data)
+}
+
+// Limit keeps at most Count messages, after skipping the first Offset.
+type Limit struct {
+	Count  int `yaml:"count"`
+	Offset int `yaml:"offset"`
+}
+
+// check rejects negative counts and offsets, so a typo can't turn a limited
+// run into one that publishes every message.
+func (l Limit) check() error {
+	if l.Count < 0 {
+		return fmt.Errorf("count can't be negative, got %d", l.Count)
+	}
+	if l.Offset < 0 {
+		return fmt.Errorf("offset can't be negative, got %d", l.Offset)
+	}
+	return nil
+}
+
+// ProcessStream implements the Stage interface for Limit. A count of zero
+// keeps every message after the offset.
+func (l Limit) ProcessStream(_ context.Context, items []Item) ([]Item, error) {
+	if err := l.check(); err != nil {
+		return nil, fmt.Errorf("limit: %w", err)
+	}
+	start := min(l.Offset, len(items))
+	end := len(items)
+	if l.Count > 0 {
+		end = min(start+l.Count, len(items))
+	}
+
+	kept := items[start:end]
+	dropped := slices.Concat(items[:start], items[end:])
+	skipDropped(kept, dropped, func(Item) string {
+		return fmt.Sprintf("outside of limit %d with offset %d", l.Count, l.Offset)
+	})
+	return kept, nil
+}
+
+// Process implements the Processor interface for Limit.
+func (l Limit) Process(ctx context.Context, data Message) (Message, error) {
+	return processOne(ctx, l, data)
+}
+
+// Sample keeps a random selection of messages, either a fixed count or a
+// percentage of them. The selection is driven by Seed, so running the same
+// plan against the same input picks the same messages. Sampled messages keep
+// their order.
+type Sample struct {
+	Count   int     `yaml:"count"`
+	Percent float64 `yaml:"percent"`
+	Seed    int64   `yaml:"seed"`
+}
+
+// check makes sure exactly one of count and percent is set, so a sample can't
+// silently drop every message.
+func (s Sample) check() error {
+	switch {
+	case s.Count != 0 && s.Percent != 0:
+		return fmt.Errorf("only one of count and percent can be set")
+	case s.Count < 0:
+		return fmt.Errorf("count must be positive, got %d", s.Count)
+	case s.Count == 0 && (s.Percent <= 0 || s.Percent > 100):
+		if s.Percent == 0 {
+			return fmt.Errorf("count or percent must be set")
+		}
+		return fmt.Errorf("percent must be more than 0 and at most 100, got %v", s.Percent)
+	}
+	return nil
+}
+
+// ProcessStream implements the Stage interface for Sample.
+func (s Sample) ProcessStream(_ context.Context, items []Item) ([]Item, error) {
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("sample: %w", err)
+	}
+	n := s.Count
+	if s.Percent > 0 {
+		n = int(math.Ceil(float64(len(items)) * s.Percent / 100))
+	}
+	n = min(n, len(items))
+
+	rng := rand.New(rand.NewSource(s.Seed)) //nolint:gosec // reproducibility matters, not unpredictability
+	picked := rng.Perm(len(items))[:n]
+	slices.Sort(picked)
+
+	var kept, dropped []Item
+	for i, item := range items {
+		if _, ok := slices.BinarySearch(picked, i); ok {
+			kept = append(kept, item)
+		} else {
+			dropped = append(dropped, item)
+		}
+	}
+
+	skipDropped(kept, dropped, func(Item) string {
+		return fmt.Sprintf("not picked by sample with seed %d", s.Seed)
+	})
+	return kept, nil
+}
+
+// Process implements the Processor interface for Sample.
+func (s Sample) Process(ctx context.Context, data Message) (Message, error) {
+	return processOne(ctx, s, data)
+}
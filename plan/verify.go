@@ -0,0 +1,95 @@
+package plan
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Verify re-reads the target after a publish and checks that the change
+// stuck, for APIs that accept a write but then normalize or ignore fields.
+type Verify struct {
+	// URL is a template with the original message as its data context. It
+	// defaults to the output URL.
+	URL string `yaml:"url"`
+	// Paths are the dot paths to compare between the sent payload and the
+	// re-read state. If there are none, every top level field of the payload
+	// is compared.
+	Paths []string `yaml:"paths"`
+}
+
+// drift is a path whose re-read value doesn't match what was sent.
+type drift struct {
+	path   string
+	sent   any
+	actual any
+}
+
+func (v Verify) paths(sent Message) []string {
+	if len(v.Paths) > 0 {
+		return v.Paths
+	}
+	m, ok := sent.(map[string]any)
+	if !ok {
+		return []string{""}
+	}
+	paths := make([]string, 0, len(m))
+	for k := range m {
+		paths = append(paths, k)
+	}
+	return paths
+}
+
+// compare returns the paths where the re-read state differs from what was
+// sent. A path missing from the sent payload is compared as nil.
+func (v Verify) compare(sent, actual Message) []drift {
+	var drifts []drift
+	for _, path := range v.paths(sent) {
+		selectors := strings.Split(path, ".")
+		if path == "" {
+			selectors = nil
+		}
+		want, _ := dive(sent, selectors)
+		got, _ := dive(actual, selectors)
+		if !reflect.DeepEqual(want, got) {
+			drifts = append(drifts, drift{path: path, sent: want, actual: got})
+		}
+	}
+	return drifts
+}
+
+// verifyHTTP re-reads the target of a publish and records any drift with the
+// reporter in the context.
+func (o Output) verifyHTTP(ctx context.Context, item Item) error {
+	verify := o.HTTP.Verify
+	url, err := o.url(item.Original)
+	if err != nil {
+		return err
+	}
+	if verify.URL != "" {
+		if url, err = renderTemplate("verify", secretTemplate(verify.URL), item.Original); err != nil {
+			return err
+		}
+	}
+
+	actual, err := o.fetch(ctx, url, item)
+	if err != nil {
+		return fmt.Errorf("verifying: %w", err)
+	}
+
+	// Normalize what was sent the same way the response was parsed, so
+	// numbers and the like compare equal.
+	sent, err := deepCopy(item.Message)
+	if err != nil {
+		return fmt.Errorf("verifying: %w", err)
+	}
+
+	drifts := verify.compare(sent, actual)
+	if reporter, ok := ctx.Value(reporterKey).(*Reporter); ok {
+		for _, d := range drifts {
+			reporter.Drift(d.path, d.sent, d.actual)
+		}
+	}
+	return nil
+}